@@ -0,0 +1,405 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cheat spots clients clicking like machines.
+//
+// Every click report is looked at per client (source IP) and per team.
+// A client caught cheating is flagged and only some of its clicks count,
+// if it keeps at it it is shadow banned and none of its clicks count.
+// Teams fed by suspiciously many clients are flagged for a moderator
+// to look at. Flags are kept in memory, so every instance has its own.
+package cheat
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Level is how suspicious a client or team is.
+type Level string
+
+// The levels of suspicion.
+const (
+	// Flagged clients only get some of their clicks counted.
+	Flagged Level = "flagged"
+	// ShadowBanned clients get none of their clicks counted,
+	// without being told.
+	ShadowBanned Level = "shadowBanned"
+)
+
+// Reason tells what gave a client or team away.
+type Reason string
+
+// The cheats looked for.
+const (
+	// Regular is clicks reported at impossibly regular intervals,
+	// with the same count every time.
+	Regular Reason = "regular"
+	// Maxed is reporting the most clicks allowed, over and over.
+	Maxed Reason = "maxed"
+	// Swarmed is many clients feeding one team.
+	Swarmed Reason = "swarmed"
+)
+
+// Flag is a suspicion about a client or a team.
+type Flag struct {
+	// Source is the flagged client, if it is not a team
+	Source string `json:"source,omitempty"`
+	// TeamID is the flagged team, if it is not a client
+	TeamID  string   `json:"team,omitempty"`
+	Level   Level    `json:"level"`
+	Reasons []Reason `json:"reasons"`
+	// Strikes is how many times the client or team was caught
+	Strikes int       `json:"strikes"`
+	Since   time.Time `json:"since"`
+	Last    time.Time `json:"last"`
+	// Discounted is how many of a client's clicks did not count
+	Discounted int64 `json:"discounted,omitempty"`
+}
+
+// Options tune the detection.
+type Options struct {
+	// Discount is the share of a flagged client's clicks that count
+	Discount float64
+	// ShadowBanStrikes is how many times a client is caught before it is shadow banned
+	ShadowBanStrikes int
+	// TeamSources is how many clients may click one team within a minute
+	TeamSources int
+	// Window is how many reports from a client are looked at together
+	Window int
+	// Regularity is the relative deviation (standard deviation over mean)
+	// of the intervals between reports that is too regular to be human
+	Regularity float64
+	// MaxedShare is the share of maxed reports in a window that is too much
+	MaxedShare float64
+	// FlagTTL is how long a flag is kept after the last strike
+	FlagTTL time.Duration
+}
+
+// DefaultOptions are lenient enough for a fast human.
+func DefaultOptions() Options {
+	return Options{
+		Discount:         0.1,
+		ShadowBanStrikes: 3,
+		TeamSources:      500,
+		Window:           50,
+		Regularity:       0.05,
+		MaxedShare:       0.9,
+		FlagTTL:          time.Hour,
+	}
+}
+
+// sourceWindow is how long a client counts as feeding a team
+var sourceWindow = time.Minute
+
+// pruneInterval is how often forgotten clients and expired flags are removed
+var pruneInterval = time.Minute
+
+// Detector looks for cheats in click reports. A nil Detector lets all clicks count.
+type Detector struct {
+	opts   Options
+	onFlag func(Flag)
+	// now is the clock, replaced in tests
+	now func() time.Time
+
+	mutex   sync.Mutex
+	clients map[string]*client
+	teams   map[string]*team
+}
+
+type client struct {
+	reports  []report
+	lastSeen time.Time
+	flag     *Flag
+	// owed is the part of a click not yet counted for a flagged client
+	owed float64
+}
+
+type report struct {
+	at     time.Time
+	count  int
+	maxed  bool
+	teamID string
+}
+
+type team struct {
+	// sources are the clients feeding the team, and when they last did
+	sources map[string]time.Time
+	flag    *Flag
+}
+
+// NewDetector creates a detector, onFlag (if any) is called
+// every time a client or team is flagged or shadow banned.
+func NewDetector(opts Options, onFlag func(Flag)) *Detector {
+	return &Detector{
+		opts:    opts,
+		onFlag:  onFlag,
+		now:     time.Now,
+		clients: make(map[string]*client),
+		teams:   make(map[string]*team),
+	}
+}
+
+// Go forgets quiet clients and expired flags, it runs forever.
+func (d *Detector) Go() {
+	for range time.Tick(pruneInterval) {
+		d.prune(d.now())
+	}
+}
+
+// Observe looks at a click report from the source, and returns how many
+// of the clicks should count. A maxed report has the most clicks allowed.
+func (d *Detector) Observe(source, teamID string, count int, maxed bool) int64 {
+	if d == nil {
+		return int64(count)
+	}
+
+	now := d.now()
+	var flagged []Flag
+
+	d.mutex.Lock()
+
+	c := d.clients[source]
+	if c == nil {
+		c = &client{}
+		d.clients[source] = c
+	}
+	c.lastSeen = now
+	c.reports = append(c.reports, report{now, count, maxed, teamID})
+	if d.opts.Window <= len(c.reports) {
+		if reasons := d.judge(c.reports); len(reasons) != 0 {
+			c.flag = d.strike(c.flag, Flag{Source: source}, reasons, now)
+			flagged = append(flagged, *c.flag)
+		}
+		// every window is judged once
+		c.reports = c.reports[:0]
+	}
+
+	t := d.teams[teamID]
+	if t == nil {
+		t = &team{sources: make(map[string]time.Time)}
+		d.teams[teamID] = t
+	}
+	t.sources[source] = now
+	if d.opts.TeamSources < len(t.sources) {
+		pruneSources(t, now)
+	}
+	// teams get at most one strike per source window
+	if d.opts.TeamSources < len(t.sources) && (t.flag == nil || sourceWindow < now.Sub(t.flag.Last)) {
+		t.flag = d.strike(t.flag, Flag{TeamID: teamID}, []Reason{Swarmed}, now)
+		// teams are only flagged, their clicks may be honest
+		t.flag.Level = Flagged
+		flagged = append(flagged, *t.flag)
+	}
+
+	credit := d.credit(c, count)
+
+	d.mutex.Unlock()
+
+	if d.onFlag != nil {
+		for _, f := range flagged {
+			d.onFlag(f)
+		}
+	}
+
+	return credit
+}
+
+// judge tells what is wrong with a window of reports, if anything
+func (d *Detector) judge(reports []report) []Reason {
+	var reasons []Reason
+
+	maxed := 0
+	sameCount := true
+	for _, r := range reports {
+		if r.maxed {
+			maxed++
+		}
+		sameCount = sameCount && r.count == reports[0].count
+	}
+	if d.opts.MaxedShare <= float64(maxed)/float64(len(reports)) {
+		reasons = append(reasons, Maxed)
+	}
+
+	if sameCount && 2 < len(reports) {
+		intervals := make([]float64, len(reports)-1)
+		for i := range intervals {
+			intervals[i] = float64(reports[i+1].at.Sub(reports[i].at))
+		}
+		mean, deviation := meanDeviation(intervals)
+		if 0 < mean && deviation/mean < d.opts.Regularity {
+			reasons = append(reasons, Regular)
+		}
+	}
+
+	return reasons
+}
+
+// strike adds a strike to the flag (or a new one), escalating it if needed
+func (d *Detector) strike(flag *Flag, fresh Flag, reasons []Reason, now time.Time) *Flag {
+	if flag == nil {
+		fresh.Since = now
+		flag = &fresh
+	}
+	flag.Strikes++
+	flag.Last = now
+	flag.Reasons = mergeReasons(flag.Reasons, reasons)
+	flag.Level = Flagged
+	if d.opts.ShadowBanStrikes <= flag.Strikes {
+		flag.Level = ShadowBanned
+	}
+	return flag
+}
+
+// credit returns how many of the clicks count for the client
+func (d *Detector) credit(c *client, count int) int64 {
+	if c.flag == nil {
+		return int64(count)
+	}
+
+	var credit int64
+	if c.flag.Level == Flagged {
+		// the fractions add up, so every 1/Discount click counts
+		c.owed += float64(count) * d.opts.Discount
+		// adding up tenths ends just short of a whole click
+		credit = int64(c.owed + 1e-9)
+		c.owed -= float64(credit)
+	}
+	c.flag.Discounted += int64(count) - credit
+	return credit
+}
+
+// Flags returns all current flags, the most recently caught first.
+func (d *Detector) Flags() []Flag {
+	if d == nil {
+		return []Flag{}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	flags := []Flag{}
+	for _, c := range d.clients {
+		if c.flag != nil {
+			flags = append(flags, copyFlag(c.flag))
+		}
+	}
+	for _, t := range d.teams {
+		if t.flag != nil {
+			flags = append(flags, copyFlag(t.flag))
+		}
+	}
+	sort.Slice(flags, func(i, j int) bool {
+		return flags[i].Last.After(flags[j].Last)
+	})
+	return flags
+}
+
+// PardonSource forgets all about the client, it tells if it was flagged.
+func (d *Detector) PardonSource(source string) bool {
+	if d == nil {
+		return false
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	c, ok := d.clients[source]
+	delete(d.clients, source)
+	return ok && c.flag != nil
+}
+
+// PardonTeam forgets all about the team, it tells if it was flagged.
+func (d *Detector) PardonTeam(teamID string) bool {
+	if d == nil {
+		return false
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	t, ok := d.teams[teamID]
+	delete(d.teams, teamID)
+	return ok && t.flag != nil
+}
+
+func (d *Detector) prune(now time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for source, c := range d.clients {
+		if c.flag != nil && d.opts.FlagTTL < now.Sub(c.flag.Last) {
+			c.flag = nil
+			c.owed = 0
+		}
+		// a quiet client's window would only be judged with a long pause in it
+		if c.flag == nil && sourceWindow < now.Sub(c.lastSeen) {
+			delete(d.clients, source)
+		}
+	}
+
+	for teamID, t := range d.teams {
+		if t.flag != nil && d.opts.FlagTTL < now.Sub(t.flag.Last) {
+			t.flag = nil
+		}
+		pruneSources(t, now)
+		if t.flag == nil && len(t.sources) == 0 {
+			delete(d.teams, teamID)
+		}
+	}
+}
+
+// pruneSources forgets the clients that no longer feed the team
+func pruneSources(t *team, now time.Time) {
+	for source, last := range t.sources {
+		if sourceWindow < now.Sub(last) {
+			delete(t.sources, source)
+		}
+	}
+}
+
+func meanDeviation(xs []float64) (float64, float64) {
+	sum := 0.0
+	for _, x := range xs {
+		sum += x
+	}
+	mean := sum / float64(len(xs))
+
+	squares := 0.0
+	for _, x := range xs {
+		squares += (x - mean) * (x - mean)
+	}
+	return mean, math.Sqrt(squares / float64(len(xs)))
+}
+
+func mergeReasons(reasons, more []Reason) []Reason {
+	for _, r := range more {
+		found := false
+		for _, known := range reasons {
+			found = found || known == r
+		}
+		if !found {
+			reasons = append(reasons, r)
+		}
+	}
+	return reasons
+}
+
+func copyFlag(f *Flag) Flag {
+	flag := *f
+	flag.Reasons = append([]Reason(nil), f.Reasons...)
+	return flag
+}
@@ -0,0 +1,287 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cheat
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// clock is a fake time for a detector
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestDetector(opts Options) (*Detector, *clock, *[]Flag) {
+	var flags []Flag
+	d := NewDetector(opts, func(f Flag) {
+		flags = append(flags, f)
+	})
+	c := &clock{epoch}
+	d.now = func() time.Time { return c.now }
+	return d, c, &flags
+}
+
+// reports made at the given intervals (in milliseconds), the counts
+// are repeated as needed and maxed means a count of 10
+func reports(intervals []int, counts ...int) []report {
+	at := epoch
+	rs := []report{{at: at, count: counts[0], maxed: counts[0] == 10}}
+	for i, ms := range intervals {
+		at = at.Add(time.Duration(ms) * time.Millisecond)
+		count := counts[(i+1)%len(counts)]
+		rs = append(rs, report{at: at, count: count, maxed: count == 10})
+	}
+	return rs
+}
+
+func repeat(n, ms int) []int {
+	intervals := make([]int, n)
+	for i := range intervals {
+		intervals[i] = ms
+	}
+	return intervals
+}
+
+func TestJudge(t *testing.T) {
+	human := []int{180, 95, 240, 130, 310, 160, 90, 220, 140}
+	jitter := []int{100, 101, 99, 100, 102, 98, 100, 101, 99}
+
+	tests := []struct {
+		name    string
+		reports []report
+		want    []Reason
+	}{
+		{"human", reports(human, 3, 5, 2, 7), nil},
+		{"same count at human pace", reports(human, 4), nil},
+		{"varying count like a clock", reports(repeat(9, 100), 3, 4), nil},
+		{"like a clock", reports(repeat(9, 100), 4), []Reason{Regular}},
+		{"like a clock with jitter", reports(jitter, 4), []Reason{Regular}},
+		{"maxed at human pace", reports(human, 10), []Reason{Maxed}},
+		{"maxed like a clock", reports(repeat(9, 100), 10), []Reason{Maxed, Regular}},
+		{"mostly maxed", reports(human, 10, 10, 10, 10, 3), nil},
+		{"nine in ten maxed", reports(human, 10, 10, 10, 10, 10, 10, 10, 10, 10, 3), []Reason{Maxed}},
+		{"all at once", reports(repeat(9, 0), 4), nil},
+	}
+
+	d := NewDetector(DefaultOptions(), nil)
+	for _, tt := range tests {
+		got := d.judge(tt.reports)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: judged %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCredit(t *testing.T) {
+	tests := []struct {
+		name       string
+		flag       *Flag
+		counts     []int
+		want       []int64
+		discounted int64
+	}{
+		{"innocent", nil, []int{1, 10, 5}, []int64{1, 10, 5}, 0},
+		{"flagged", &Flag{Level: Flagged}, []int{10, 10, 5}, []int64{1, 1, 0}, 23},
+		{"flagged clicks add up", &Flag{Level: Flagged}, []int{5, 5, 5, 5}, []int64{0, 1, 0, 1}, 18},
+		{"flagged tenths add up", &Flag{Level: Flagged}, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}, []int64{0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 9},
+		{"shadow banned", &Flag{Level: ShadowBanned}, []int{10, 10, 5}, []int64{0, 0, 0}, 25},
+	}
+
+	d := NewDetector(DefaultOptions(), nil)
+	for _, tt := range tests {
+		c := &client{flag: tt.flag}
+		var got []int64
+		for _, count := range tt.counts {
+			got = append(got, d.credit(c, count))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: credited %v, want %v", tt.name, got, tt.want)
+		}
+		if c.flag != nil && c.flag.Discounted != tt.discounted {
+			t.Errorf("%s: discounted %d, want %d", tt.name, c.flag.Discounted, tt.discounted)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	ago := func(d time.Duration) time.Time { return epoch.Add(-d) }
+	flag := func(last time.Duration) *Flag { return &Flag{Level: Flagged, Last: ago(last)} }
+
+	tests := []struct {
+		name        string
+		client      *client
+		team        *team
+		keepClient  bool
+		keepTeam    bool
+		clientFlag  bool
+		teamFlag    bool
+		teamSources int
+	}{
+		{
+			name:       "active",
+			client:     &client{lastSeen: ago(time.Second)},
+			team:       &team{sources: map[string]time.Time{"ip": ago(time.Second)}},
+			keepClient: true, keepTeam: true, teamSources: 1,
+		},
+		{
+			name:   "quiet",
+			client: &client{lastSeen: ago(2 * time.Minute)},
+			team:   &team{sources: map[string]time.Time{"ip": ago(2 * time.Minute)}},
+		},
+		{
+			name:       "quiet but flagged",
+			client:     &client{lastSeen: ago(2 * time.Minute), flag: flag(30 * time.Minute)},
+			team:       &team{sources: map[string]time.Time{"ip": ago(2 * time.Minute)}, flag: flag(30 * time.Minute)},
+			keepClient: true, keepTeam: true, clientFlag: true, teamFlag: true,
+		},
+		{
+			name:   "flags expired",
+			client: &client{lastSeen: ago(2 * time.Hour), flag: flag(2 * time.Hour), owed: 0.5},
+			team:   &team{sources: map[string]time.Time{}, flag: flag(2 * time.Hour)},
+		},
+		{
+			name:       "flags expired while still clicking",
+			client:     &client{lastSeen: ago(time.Second), flag: flag(2 * time.Hour), owed: 0.5},
+			team:       &team{sources: map[string]time.Time{"ip": ago(time.Second), "other": ago(2 * time.Minute)}, flag: flag(2 * time.Hour)},
+			keepClient: true, keepTeam: true, teamSources: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		d := NewDetector(DefaultOptions(), nil)
+		d.clients["ip"] = tt.client
+		d.teams["🐱"] = tt.team
+
+		d.prune(epoch)
+
+		c, keptClient := d.clients["ip"]
+		if keptClient != tt.keepClient {
+			t.Errorf("%s: kept client %v, want %v", tt.name, keptClient, tt.keepClient)
+		} else if keptClient && (c.flag != nil) != tt.clientFlag {
+			t.Errorf("%s: client flag %v, want flagged %v", tt.name, c.flag, tt.clientFlag)
+		} else if keptClient && c.flag == nil && c.owed != 0 {
+			t.Errorf("%s: pardoned client still owed %v", tt.name, c.owed)
+		}
+
+		tm, keptTeam := d.teams["🐱"]
+		if keptTeam != tt.keepTeam {
+			t.Errorf("%s: kept team %v, want %v", tt.name, keptTeam, tt.keepTeam)
+		} else if keptTeam && (tm.flag != nil) != tt.teamFlag {
+			t.Errorf("%s: team flag %v, want flagged %v", tt.name, tm.flag, tt.teamFlag)
+		} else if keptTeam && len(tm.sources) != tt.teamSources {
+			t.Errorf("%s: team has %d sources, want %d", tt.name, len(tm.sources), tt.teamSources)
+		}
+	}
+}
+
+func TestStrikes(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Window = 3
+	d, c, flags := newTestDetector(opts)
+
+	// a bot clicking like a clock is caught once per window
+	var credits []int64
+	for i := 0; i < 3*opts.ShadowBanStrikes; i++ {
+		c.advance(100 * time.Millisecond)
+		credits = append(credits, d.Observe("bot", "🐱", 10, true))
+	}
+
+	var levels []Level
+	for _, f := range *flags {
+		levels = append(levels, f.Level)
+	}
+	if want := []Level{Flagged, Flagged, ShadowBanned}; !reflect.DeepEqual(levels, want) {
+		t.Errorf("levels %v, want %v", levels, want)
+	}
+	// the report completing a window is credited after judging it
+	if want := []int64{10, 10, 1, 1, 1, 1, 1, 1, 0}; !reflect.DeepEqual(credits, want) {
+		t.Errorf("credits %v, want %v", credits, want)
+	}
+
+	if !d.PardonSource("bot") {
+		t.Errorf("the bot was not flagged")
+	}
+	if got := d.Observe("bot", "🐱", 10, true); got != 10 {
+		t.Errorf("pardoned bot credited %d, want 10", got)
+	}
+}
+
+func TestSwarm(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TeamSources = 3
+	d, c, flags := newTestDetector(opts)
+
+	click := func(sources int) {
+		for i := 0; i < sources; i++ {
+			if got := d.Observe(fmt.Sprintf("10.0.0.%d", i), "🐱", 1, false); got != 1 {
+				t.Errorf("a swarmed team's click credited %d, want 1", got)
+			}
+		}
+	}
+
+	click(3)
+	if len(*flags) != 0 {
+		t.Fatalf("flagged %v, but there were only enough sources", *flags)
+	}
+
+	// one strike per minute, no matter how many more join
+	click(5)
+	c.advance(30 * time.Second)
+	click(5)
+	if len(*flags) != 1 {
+		t.Fatalf("flagged %d times within a minute, want once", len(*flags))
+	}
+
+	c.advance(45 * time.Second)
+	click(5)
+	if len(*flags) != 2 {
+		t.Fatalf("flagged %d times, want a second strike after a minute", len(*flags))
+	}
+	f := (*flags)[1]
+	if f.TeamID != "🐱" || f.Level != Flagged || f.Strikes != 2 || !reflect.DeepEqual(f.Reasons, []Reason{Swarmed}) {
+		t.Errorf("flag %+v, want the team flagged as swarmed with 2 strikes", f)
+	}
+
+	// the sources drift away
+	c.advance(2 * time.Minute)
+	d.prune(c.now)
+	click(2)
+	if got := len(d.teams["🐱"].sources); got != 2 {
+		t.Errorf("team has %d sources, want only the 2 recent ones", got)
+	}
+
+	if !d.PardonTeam("🐱") || d.PardonTeam("🐱") {
+		t.Errorf("the team should be pardoned once")
+	}
+}
+
+func TestNilDetector(t *testing.T) {
+	var d *Detector
+	if got := d.Observe("ip", "🐱", 7, true); got != 7 {
+		t.Errorf("nil detector credited %d, want 7", got)
+	}
+	if flags := d.Flags(); len(flags) != 0 {
+		t.Errorf("nil detector has flags %v", flags)
+	}
+}
@@ -0,0 +1,418 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config reads the server configuration.
+//
+// Settings are read from defaults, a YAML file, the environment and
+// command line flags, each overriding the ones before it.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/fabjan/mmocg/cheat"
+	"github.com/fabjan/mmocg/season"
+	"github.com/fabjan/mmocg/server"
+	"github.com/fabjan/mmocg/store"
+)
+
+// Config is everything the server can be configured with.
+type Config struct {
+	Port int `yaml:"port"`
+	// AllowOrigins are the patterns allowed as origin in CORS
+	AllowOrigins []string `yaml:"allowOrigins"`
+	// Seasons are on the form ID,START,END with RFC 3339 times
+	Seasons []string `yaml:"seasons"`
+	Journal Journal  `yaml:"journal"`
+	// ClickBatch is how long Postgres clicks are batched, 0 writes them right away
+	ClickBatch time.Duration `yaml:"clickBatch"`
+	// DrainTimeout is how long shutting down may take
+	DrainTimeout  time.Duration `yaml:"drainTimeout"`
+	Limits        Limits        `yaml:"limits"`
+	Stream        Stream        `yaml:"stream"`
+	Announcements Announcements `yaml:"announcements"`
+	ClientIP      ClientIP      `yaml:"clientIP"`
+	AntiCheat     AntiCheat     `yaml:"antiCheat"`
+	Secrets       Secrets       `yaml:"secrets"`
+}
+
+// Journal configures the in-memory store's journal.
+type Journal struct {
+	// Dir is where the journal is kept, the store is not durable without one
+	Dir string `yaml:"dir"`
+	// Sync is op, batch or interval
+	Sync string `yaml:"sync"`
+}
+
+// Limits keep clients from overdoing it.
+type Limits struct {
+	// RequestsPerSecond is allowed per client IP
+	RequestsPerSecond float64 `yaml:"requestsPerSecond"`
+	// MinClicks and MaxClicks bound the clicks reported at once
+	MinClicks int `yaml:"minClicks"`
+	MaxClicks int `yaml:"maxClicks"`
+	// MaxClicksPerBatch flushes a click batch early
+	MaxClicksPerBatch int64 `yaml:"maxClicksPerBatch"`
+	// LeaderboardSize is the most teams listed at once
+	LeaderboardSize int `yaml:"leaderboardSize"`
+}
+
+// Stream configures the leaderboard stream.
+type Stream struct {
+	PushesPerSecond int `yaml:"pushesPerSecond"`
+}
+
+// Announcements configures the announcement spammer, where to announce
+// is configured as described by PSA.
+type Announcements struct {
+	PerSecond int `yaml:"perSecond"`
+}
+
+// ClientIP tells where to find the client IP, rate limits, the audit trail
+// and the cheat detector all go by it.
+type ClientIP struct {
+	// Lookups are tried in order: RemoteAddr, X-Forwarded-For or X-Real-IP,
+	// the headers must only be used behind a proxy that sets them
+	Lookups []string `yaml:"lookups"`
+	// Proxies is how many proxies in front of the server add to X-Forwarded-For
+	Proxies int `yaml:"proxies"`
+}
+
+// AntiCheat configures the cheat detector.
+type AntiCheat struct {
+	Enabled bool `yaml:"enabled"`
+	// Discount is the share of a flagged client's clicks that count
+	Discount float64 `yaml:"discount"`
+	// ShadowBanStrikes is how many times a client is caught before none of its clicks count
+	ShadowBanStrikes int `yaml:"shadowBanStrikes"`
+	// TeamSources is how many client IPs may click one team within a minute
+	TeamSources int `yaml:"teamSources"`
+}
+
+// Secrets are never printed.
+type Secrets struct {
+	UptraceDSN  string `yaml:"uptraceDSN"`
+	DatabaseURL string `yaml:"databaseURL"`
+	// AdminToken enables the admin API, requests must carry it as a bearer token
+	AdminToken string `yaml:"adminToken"`
+}
+
+// Default returns the configuration used when nothing else is given.
+func Default() Config {
+	return Config{
+		Port: 5000,
+		Journal: Journal{
+			Sync: string(store.SyncBatched),
+		},
+		DrainTimeout: 15 * time.Second,
+		Limits: Limits{
+			RequestsPerSecond: 10,
+			MinClicks:         1,
+			MaxClicks:         10,
+			MaxClicksPerBatch: 1000,
+			LeaderboardSize:   640,
+		},
+		Stream: Stream{
+			PushesPerSecond: 2,
+		},
+		Announcements: Announcements{
+			PerSecond: 1,
+		},
+		ClientIP: ClientIP{
+			Lookups: []string{"RemoteAddr"},
+			Proxies: 1,
+		},
+		AntiCheat: AntiCheat{
+			Enabled:          true,
+			Discount:         cheat.DefaultOptions().Discount,
+			ShadowBanStrikes: cheat.DefaultOptions().ShadowBanStrikes,
+			TeamSources:      cheat.DefaultOptions().TeamSources,
+		},
+	}
+}
+
+// FileEnv names the environment variable with the config file path,
+// the -config flag takes precedence.
+const FileEnv = "MMOCG_CONFIG"
+
+// Load reads the configuration for the given command line arguments,
+// and returns it together with the arguments left after the flags.
+// The configuration is validated.
+func Load(args []string) (Config, []string, error) {
+
+	// the flags are parsed twice, first to find the file
+	scratch := Default()
+	path, err := defineFlags(flag.NewFlagSet("mmocg", flag.ContinueOnError), &scratch, args)
+	if err != nil {
+		return scratch, nil, err
+	}
+	if *path == "" {
+		*path = os.Getenv(FileEnv)
+	}
+
+	cfg := Default()
+
+	if *path != "" {
+		err = cfg.readFile(*path)
+		if err != nil {
+			return cfg, nil, err
+		}
+	}
+
+	err = cfg.readEnv()
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	fs := flag.NewFlagSet("mmocg", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard) // any errors were reported the first time
+	defineFlags(fs, &cfg, args)
+
+	return cfg, fs.Args(), cfg.Validate()
+}
+
+// defineFlags defines flags overriding cfg and parses the arguments,
+// it returns the config file flag.
+func defineFlags(fs *flag.FlagSet, cfg *Config, args []string) (*string, error) {
+	path := fs.String("config", "", "YAML config file, also read from $"+FileEnv+".")
+	fs.Var(&listFlag{list: &cfg.AllowOrigins}, "allow-origin", "Patterns to allow as origin in CORS.")
+	fs.Var(&listFlag{list: &cfg.Seasons}, "season", "Season as ID,START,END with RFC 3339 times.")
+	fs.StringVar(&cfg.Journal.Dir, "journal-dir", cfg.Journal.Dir, "Directory for the in-memory store's journal, if it should be durable.")
+	fs.StringVar(&cfg.Journal.Sync, "journal-sync", cfg.Journal.Sync, "When to sync the journal to disk: op, batch or interval.")
+	fs.DurationVar(&cfg.ClickBatch, "click-batch", cfg.ClickBatch, "How long Postgres clicks are batched before they are written, 0 writes them right away.")
+	fs.DurationVar(&cfg.DrainTimeout, "drain-timeout", cfg.DrainTimeout, "How long to wait for requests and announcements to finish when shutting down.")
+
+	err := fs.Parse(args)
+	return path, err
+}
+
+func (cfg *Config) readFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(cfg)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (cfg *Config) readEnv() error {
+	if port := os.Getenv("PORT"); port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			return fmt.Errorf("invalid PORT %q", port)
+		}
+		cfg.Port = n
+	}
+
+	err := readSecret("UPTRACE_DSN", &cfg.Secrets.UptraceDSN)
+	if err != nil {
+		return err
+	}
+	err = readSecret("DATABASE_URL", &cfg.Secrets.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	return readSecret("ADMIN_TOKEN", &cfg.Secrets.AdminToken)
+}
+
+// readSecret reads the secret from the named environment variable,
+// or from the file named by the same variable suffixed with _FILE.
+func readSecret(name string, secret *string) error {
+	value := os.Getenv(name)
+	path := os.Getenv(name + "_FILE")
+
+	switch {
+	case value != "" && path != "":
+		return fmt.Errorf("both %s and %s_FILE are set", name, name)
+	case value != "":
+		*secret = value
+	case path != "":
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("cannot read %s_FILE: %w", name, err)
+		}
+		*secret = strings.TrimSpace(string(data))
+	}
+	return nil
+}
+
+// Validate tells what is wrong with the configuration, if anything.
+func (cfg Config) Validate() error {
+	if cfg.Port < 1 || 65535 < cfg.Port {
+		return fmt.Errorf("port %d is out of range", cfg.Port)
+	}
+	if _, err := cfg.ParseSeasons(); err != nil {
+		return err
+	}
+	if _, err := cfg.JournalOptions(); err != nil {
+		return err
+	}
+	if cfg.ClickBatch < 0 {
+		return errors.New("clickBatch must not be negative")
+	}
+	if cfg.DrainTimeout <= 0 {
+		return errors.New("drainTimeout must be positive")
+	}
+
+	l := cfg.Limits
+	if l.RequestsPerSecond <= 0 {
+		return errors.New("limits.requestsPerSecond must be positive")
+	}
+	if l.MinClicks < 1 || l.MaxClicks < l.MinClicks {
+		return fmt.Errorf("limits.minClicks %d and maxClicks %d are not a valid range", l.MinClicks, l.MaxClicks)
+	}
+	if l.MaxClicksPerBatch < 1 {
+		return errors.New("limits.maxClicksPerBatch must be positive")
+	}
+	if l.LeaderboardSize < 1 {
+		return errors.New("limits.leaderboardSize must be positive")
+	}
+
+	if cfg.Stream.PushesPerSecond < 1 {
+		return errors.New("stream.pushesPerSecond must be positive")
+	}
+	if cfg.Announcements.PerSecond < 1 {
+		return errors.New("announcements.perSecond must be positive")
+	}
+
+	if len(cfg.ClientIP.Lookups) == 0 {
+		return errors.New("clientIP.lookups must not be empty")
+	}
+	for _, lookup := range cfg.ClientIP.Lookups {
+		switch lookup {
+		case "RemoteAddr", "X-Forwarded-For", "X-Real-IP":
+		default:
+			return fmt.Errorf("unknown clientIP lookup %q", lookup)
+		}
+	}
+	if cfg.ClientIP.Proxies < 1 {
+		return errors.New("clientIP.proxies must be positive")
+	}
+
+	a := cfg.AntiCheat
+	if a.Discount < 0 || 1 < a.Discount {
+		return fmt.Errorf("antiCheat.discount %v is not between 0 and 1", a.Discount)
+	}
+	if a.ShadowBanStrikes < 1 {
+		return errors.New("antiCheat.shadowBanStrikes must be positive")
+	}
+	if a.TeamSources < 1 {
+		return errors.New("antiCheat.teamSources must be positive")
+	}
+
+	return nil
+}
+
+// ParseSeasons returns the configured seasons.
+func (cfg Config) ParseSeasons() ([]server.Season, error) {
+	var seasons []server.Season
+	for _, def := range cfg.Seasons {
+		s, err := season.Parse(def)
+		if err != nil {
+			return nil, fmt.Errorf("invalid season: %w", err)
+		}
+		seasons = append(seasons, s)
+	}
+	return seasons, nil
+}
+
+// JournalOptions returns the journal options, or nil if there is no journal.
+func (cfg Config) JournalOptions() (*store.JournalOptions, error) {
+	if cfg.Journal.Dir == "" {
+		return nil, nil
+	}
+	sync, err := store.ParseSyncPolicy(cfg.Journal.Sync)
+	if err != nil {
+		return nil, fmt.Errorf("invalid journal sync: %w", err)
+	}
+	return &store.JournalOptions{
+		Dir:              cfg.Journal.Dir,
+		Sync:             sync,
+		BatchSize:        100,
+		Interval:         time.Second,
+		SnapshotInterval: 5 * time.Minute,
+	}, nil
+}
+
+// CheatOptions returns the cheat detector options, or nil if it is disabled.
+func (cfg Config) CheatOptions() *cheat.Options {
+	if !cfg.AntiCheat.Enabled {
+		return nil
+	}
+	opts := cheat.DefaultOptions()
+	opts.Discount = cfg.AntiCheat.Discount
+	opts.ShadowBanStrikes = cfg.AntiCheat.ShadowBanStrikes
+	opts.TeamSources = cfg.AntiCheat.TeamSources
+	return &opts
+}
+
+const redacted = "<redacted>"
+
+// Redacted returns the configuration without secrets, safe for printing.
+func (cfg Config) Redacted() Config {
+	if cfg.Secrets.UptraceDSN != "" {
+		cfg.Secrets.UptraceDSN = redacted
+	}
+	if cfg.Secrets.DatabaseURL != "" {
+		cfg.Secrets.DatabaseURL = redacted
+	}
+	if cfg.Secrets.AdminToken != "" {
+		cfg.Secrets.AdminToken = redacted
+	}
+	return cfg
+}
+
+// YAML encodes the configuration on the config file format.
+func (cfg Config) YAML() ([]byte, error) {
+	return yaml.Marshal(cfg)
+}
+
+// listFlag collects repeated flags, replacing any list from the file or environment.
+type listFlag struct {
+	list *[]string
+	set  bool
+}
+
+func (f *listFlag) String() string {
+	if f.list == nil {
+		return "[]"
+	}
+	return "[" + strings.Join(*f.list, ", ") + "]"
+}
+
+func (f *listFlag) Set(value string) error {
+	if !f.set {
+		*f.list = nil
+		f.set = true
+	}
+	*f.list = append(*f.list, value)
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+)
+
+// Runtime keeps the configuration of a running server and reloads it.
+//
+// Only the rate limit, click bounds, allowed origins and announcement rate
+// change on a reload, other changes are logged and wait for a restart.
+type Runtime struct {
+	load func() (Config, error)
+
+	mutex    sync.Mutex
+	current  Config
+	watchers []func(Config)
+}
+
+// NewRuntime starts out with the given configuration, and uses the
+// load function to read it again.
+func NewRuntime(cfg Config, load func() (Config, error)) *Runtime {
+	return &Runtime{
+		load:    load,
+		current: cfg,
+	}
+}
+
+// Current returns the configuration in use.
+func (rt *Runtime) Current() Config {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	return rt.current
+}
+
+// Watch calls apply with the configuration after every reload.
+func (rt *Runtime) Watch(apply func(Config)) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	rt.watchers = append(rt.watchers, apply)
+}
+
+// Reload reads the configuration again and applies the runtime settings,
+// nothing changes if the new configuration is invalid. It returns the
+// settings that changed, e.g. "limits.maxClicks: 10 -> 20".
+func (rt *Runtime) Reload() ([]string, error) {
+	next, err := rt.load()
+	if err != nil {
+		return nil, err
+	}
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	applied := rt.current
+	applied.Limits.RequestsPerSecond = next.Limits.RequestsPerSecond
+	applied.Limits.MinClicks = next.Limits.MinClicks
+	applied.Limits.MaxClicks = next.Limits.MaxClicks
+	applied.AllowOrigins = next.AllowOrigins
+	applied.Announcements = next.Announcements
+
+	if !reflect.DeepEqual(applied, next) {
+		log.Printf("some config changes need a restart to take effect")
+	}
+
+	changes := runtimeChanges(rt.current, applied)
+
+	rt.current = applied
+	for _, apply := range rt.watchers {
+		apply(applied)
+	}
+
+	log.Printf("config reloaded")
+	return changes, nil
+}
+
+// runtimeChanges describes how the runtime settings differ
+func runtimeChanges(old, new Config) []string {
+	var changes []string
+	change := func(name string, from, to interface{}) {
+		if !reflect.DeepEqual(from, to) {
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", name, from, to))
+		}
+	}
+	change("limits.requestsPerSecond", old.Limits.RequestsPerSecond, new.Limits.RequestsPerSecond)
+	change("limits.minClicks", old.Limits.MinClicks, new.Limits.MinClicks)
+	change("limits.maxClicks", old.Limits.MaxClicks, new.Limits.MaxClicks)
+	change("allowOrigins", old.AllowOrigins, new.AllowOrigins)
+	change("announcements.perSecond", old.Announcements.PerSecond, new.Announcements.PerSecond)
+	return changes
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package emoji
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Category is a kind of emoji sequence.
+type Category string
+
+// The categories an emoji can be in, it can be in more than one
+// (e.g. a ZWJ sequence with a skin tone).
+const (
+	// Flag is a pair of regional indicators, i.e. a country flag.
+	Flag Category = "flag"
+	// Subdivision is a tag sequence, e.g. the flag of Scotland.
+	Subdivision Category = "subdivision"
+	// Keycap is a digit, # or * in a keycap.
+	Keycap Category = "keycap"
+	// SkinTone is any emoji with a skin tone modifier.
+	SkinTone Category = "skinTone"
+	// ZWJ is a sequence of emoji joined by zero width joiners.
+	ZWJ Category = "zwj"
+)
+
+// Categories lists all categories.
+var Categories = []Category{Flag, Subdivision, Keycap, SkinTone, ZWJ}
+
+// ParseCategory returns the category with the given name.
+func ParseCategory(name string) (Category, error) {
+	for _, c := range Categories {
+		if string(c) == name {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("unknown emoji category %q", name)
+}
+
+// Split returns the emoji in s one by one, in canonical form.
+// It returns nil if s is not a short sequence of well-formed emoji.
+func Split(s string) []string {
+	if !Valid(s) {
+		return nil
+	}
+
+	p := parser{runes: []rune(s)}
+	var graphemes []string
+	for !p.done() {
+		var sb strings.Builder
+		p.sequence(&sb)
+		graphemes = append(graphemes, sb.String())
+	}
+	return graphemes
+}
+
+// InCategory reports whether any emoji in s is in the category.
+func InCategory(s string, c Category) bool {
+	for _, g := range Split(s) {
+		if isInCategory([]rune(g), c) {
+			return true
+		}
+	}
+	return false
+}
+
+// isInCategory tells if a single canonical emoji is in the category
+func isInCategory(g []rune, c Category) bool {
+	switch c {
+	case Flag:
+		return isRegional(g[0])
+	case Keycap:
+		return isKeycapBase(g[0])
+	}
+
+	for _, r := range g {
+		switch {
+		case c == Subdivision && isTag(r):
+			return true
+		case c == SkinTone && isModifier(r):
+			return true
+		case c == ZWJ && r == zwj:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,231 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package emoji validates and normalizes emoji strings.
+//
+// Only well-formed emoji sequences as described in Unicode Technical
+// Standard #51 are accepted: single emoji (optionally with a skin tone
+// modifier), flags, keycaps, tag sequences and ZWJ sequences of those.
+package emoji
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxGraphemes is the most emoji allowed in a normalized string.
+var MaxGraphemes = 8
+
+var (
+	// ErrEmpty is returned for the empty string.
+	ErrEmpty = errors.New("no emoji")
+	// ErrTooLong is returned when there are more than MaxGraphemes emoji.
+	ErrTooLong = errors.New("too many emoji")
+	// ErrNotEmoji is returned when something other than emoji is found.
+	ErrNotEmoji = errors.New("not emoji")
+)
+
+const (
+	zwj          = '\u200D'
+	vs15         = '\uFE0E' // text presentation selector
+	vs16         = '\uFE0F' // emoji presentation selector
+	keycap       = '\u20E3'
+	blackFlag    = '\U0001F3F4'
+	tagCancel    = '\U000E007F'
+	tagFirst     = '\U000E0020'
+	tagLast      = '\U000E007E'
+	modFirst     = '\U0001F3FB'
+	modLast      = '\U0001F3FF'
+	regionalA    = '\U0001F1E6'
+	regionalZ    = '\U0001F1FF'
+	maxZWJLength = 10 // no RGI sequence comes close, but be generous
+)
+
+// Normalize returns the canonical form of s, or an error if s is not
+// a short sequence of well-formed emoji.
+//
+// In the canonical form every emoji that does not default to emoji
+// presentation is followed by U+FE0F, and no other variation selectors
+// remain, so e.g. "❤" and "❤️" normalize to the same string.
+func Normalize(s string) (string, error) {
+	if s == "" {
+		return "", ErrEmpty
+	}
+	if !utf8.ValidString(s) {
+		return "", ErrNotEmoji
+	}
+
+	p := parser{runes: []rune(s)}
+	var sb strings.Builder
+	count := 0
+	for !p.done() {
+		if err := p.sequence(&sb); err != nil {
+			return "", err
+		}
+		count++
+		if MaxGraphemes < count {
+			return "", ErrTooLong
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// Valid reports whether s is a short sequence of well-formed emoji.
+func Valid(s string) bool {
+	_, err := Normalize(s)
+	return err == nil
+}
+
+type parser struct {
+	runes []rune
+	pos   int
+}
+
+func (p *parser) done() bool {
+	return len(p.runes) <= p.pos
+}
+
+func (p *parser) peek() rune {
+	if p.done() {
+		return utf8.RuneError
+	}
+	return p.runes[p.pos]
+}
+
+// skipSelectors consumes any variation selectors, they are
+// added back where needed by the canonical form.
+func (p *parser) skipSelectors() {
+	for r := p.peek(); r == vs15 || r == vs16; r = p.peek() {
+		p.pos++
+	}
+}
+
+// sequence writes one emoji (a single grapheme) in canonical form.
+func (p *parser) sequence(sb *strings.Builder) error {
+	r := p.peek()
+
+	if isRegional(r) {
+		return p.flag(sb)
+	}
+	if isKeycapBase(r) {
+		return p.keycap(sb)
+	}
+
+	for elements := 1; ; elements++ {
+		if maxZWJLength < elements {
+			return ErrNotEmoji
+		}
+		if err := p.element(sb); err != nil {
+			return err
+		}
+		if p.peek() != zwj {
+			return nil
+		}
+		p.pos++
+		sb.WriteRune(zwj)
+	}
+}
+
+// flag is a pair of regional indicators.
+func (p *parser) flag(sb *strings.Builder) error {
+	if len(p.runes) < p.pos+2 || !isRegional(p.runes[p.pos+1]) {
+		return ErrNotEmoji
+	}
+	sb.WriteRune(p.runes[p.pos])
+	sb.WriteRune(p.runes[p.pos+1])
+	p.pos += 2
+	return nil
+}
+
+// keycap is one of [0-9#*] followed by U+20E3 (canonically with U+FE0F).
+func (p *parser) keycap(sb *strings.Builder) error {
+	base := p.runes[p.pos]
+	p.pos++
+	p.skipSelectors()
+	if p.peek() != keycap {
+		return ErrNotEmoji
+	}
+	p.pos++
+	sb.WriteRune(base)
+	sb.WriteRune(vs16)
+	sb.WriteRune(keycap)
+	return nil
+}
+
+// element is a pictographic emoji with an optional modifier or tag
+// sequence, i.e. anything that can be joined by ZWJ.
+func (p *parser) element(sb *strings.Builder) error {
+	base := p.peek()
+	if !isPictographic(base) {
+		return ErrNotEmoji
+	}
+	p.pos++
+	p.skipSelectors()
+	sb.WriteRune(base)
+
+	next := p.peek()
+	switch {
+	case isModifier(next):
+		if !isModifierBase(base) {
+			return ErrNotEmoji
+		}
+		p.pos++
+		sb.WriteRune(next)
+		p.skipSelectors()
+	case base == blackFlag && isTag(next):
+		for isTag(p.peek()) {
+			sb.WriteRune(p.peek())
+			p.pos++
+		}
+		if p.peek() != tagCancel {
+			return ErrNotEmoji
+		}
+		sb.WriteRune(tagCancel)
+		p.pos++
+	case !isPresentation(base):
+		sb.WriteRune(vs16)
+	}
+
+	return nil
+}
+
+func isRegional(r rune) bool {
+	return regionalA <= r && r <= regionalZ
+}
+
+func isKeycapBase(r rune) bool {
+	return r == '#' || r == '*' || ('0' <= r && r <= '9')
+}
+
+func isModifier(r rune) bool {
+	return modFirst <= r && r <= modLast
+}
+
+func isTag(r rune) bool {
+	return tagFirst <= r && r <= tagLast
+}
+
+func isPictographic(r rune) bool {
+	return inTable(r, pictographic)
+}
+
+func isPresentation(r rune) bool {
+	return inTable(r, presentation)
+}
+
+func isModifierBase(r rune) bool {
+	return inTable(r, modifierBase)
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package emoji
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+		err  error
+	}{
+		// rejected text
+		{"empty", "", "", ErrEmpty},
+		{"letters", "cat", "", ErrNotEmoji},
+		{"emoji then letters", "🐱cat", "", ErrNotEmoji},
+		{"space", "🐱 🐶", "", ErrNotEmoji},
+		{"invalid utf-8", "\xff", "", ErrNotEmoji},
+		{"digit without keycap", "1", "", ErrNotEmoji},
+		{"lone selector", "\uFE0F", "", ErrNotEmoji},
+		{"lone zwj", "\u200D", "", ErrNotEmoji},
+		{"trailing zwj", "🐱\u200D", "", ErrNotEmoji},
+
+		// plain emoji
+		{"presentation", "🐱", "🐱", nil},
+		{"several", "🐱🐶", "🐱🐶", nil},
+
+		// variation selectors
+		{"text default gets vs16", "❤", "❤\uFE0F", nil},
+		{"vs16 kept", "❤\uFE0F", "❤\uFE0F", nil},
+		{"vs15 becomes vs16", "❤\uFE0E", "❤\uFE0F", nil},
+		{"vs16 dropped on presentation", "🐱\uFE0F", "🐱", nil},
+		{"repeated selectors", "🐱\uFE0F\uFE0F", "🐱", nil},
+
+		// skin tones
+		{"modifier", "👍🏽", "👍🏽", nil},
+		{"bare modifier", "🏻", "", ErrNotEmoji},
+		{"modifier without base", "🐱🏻", "", ErrNotEmoji},
+		{"modifiers only", "🏻🏿", "", ErrNotEmoji},
+
+		// flags
+		{"flag", "🇸🇪", "🇸🇪", nil},
+		{"two flags", "🇸🇪🇳🇴", "🇸🇪🇳🇴", nil},
+		{"half flag", "🇸", "", ErrNotEmoji},
+		{"regional then emoji", "🇸🐱", "", ErrNotEmoji},
+
+		// keycaps
+		{"keycap", "1\uFE0F\u20E3", "1\uFE0F\u20E3", nil},
+		{"keycap without vs16", "#\u20E3", "#\uFE0F\u20E3", nil},
+		{"bare keycap mark", "\u20E3", "", ErrNotEmoji},
+
+		// tag sequences
+		{"scotland", "🏴\U000E0067\U000E0062\U000E0073\U000E0063\U000E0074\U000E007F", "🏴\U000E0067\U000E0062\U000E0073\U000E0063\U000E0074\U000E007F", nil},
+		{"unterminated tags", "🏴\U000E0067\U000E0062", "", ErrNotEmoji},
+		{"tags on other emoji", "🐱\U000E0067\U000E007F", "", ErrNotEmoji},
+
+		// ZWJ sequences
+		{"zwj", "🐈\u200D⬛", "🐈\u200D⬛", nil},
+		{"zwj with selectors", "❤\u200D🔥", "❤\uFE0F\u200D🔥", nil},
+		{"zwj with modifier", "🧑🏽\u200D🚀", "🧑🏽\u200D🚀", nil},
+		{"zwj too long", strings.Repeat("🐱\u200D", 10) + "🐱", "", ErrNotEmoji},
+
+		// length
+		{"max length", strings.Repeat("🐱", MaxGraphemes), strings.Repeat("🐱", MaxGraphemes), nil},
+		{"too long", strings.Repeat("🐱", MaxGraphemes+1), "", ErrTooLong},
+		{"flags count once each", strings.Repeat("🇸🇪", MaxGraphemes), strings.Repeat("🇸🇪", MaxGraphemes), nil},
+	}
+
+	for _, tt := range tests {
+		got, err := Normalize(tt.in)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: Normalize(%q) error = %v, want %v", tt.name, tt.in, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: Normalize(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package events passes game events from the stores to whoever is interested.
+package events
+
+import "sync"
+
+// Kind tells what happened.
+type Kind string
+
+// The events published by the stores.
+const (
+	TeamCreated    Kind = "teamCreated"
+	LeaderChanged  Kind = "leaderChanged"
+	ClicksRecorded Kind = "clicksRecorded"
+	// TeamChanged is published when a team is changed by a moderator,
+	// e.g. deleted, renamed or reset
+	TeamChanged Kind = "teamChanged"
+	// BansChanged is published when a ban is added or removed,
+	// it is not about any single team
+	BansChanged Kind = "bansChanged"
+)
+
+// Event is something that happened to a team.
+type Event struct {
+	Kind   Kind   `json:"kind"`
+	TeamID string `json:"team"`
+	// Count is the number of clicks recorded
+	Count int64 `json:"count,omitempty"`
+}
+
+// Policy decides what happens to events published to a full subscription.
+type Policy int
+
+// The available policies.
+const (
+	// DropNewest drops the published event.
+	DropNewest Policy = iota
+	// DropOldest drops the oldest queued event to make room.
+	DropOldest
+	// Coalesce replaces any queued event of the same kind, so only the
+	// latest one is delivered. If there is none it behaves like DropOldest.
+	Coalesce
+)
+
+// Bus delivers published events to all subscribers.
+//
+// Publishing never blocks, each subscription has a bounded buffer
+// and a policy for when it is full. A nil Bus drops all events.
+type Bus struct {
+	mutex sync.RWMutex
+	subs  map[*Subscription]struct{}
+}
+
+// NewBus creates a bus without subscribers.
+func NewBus() *Bus {
+	return &Bus{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish sends the event to every subscription interested in its kind.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for sub := range b.subs {
+		if sub.wants(e.Kind) {
+			sub.push(e)
+		}
+	}
+}
+
+// Subscribe starts delivering events of the given kinds (or all kinds if
+// none are given) on the returned subscription. At most size events are
+// buffered, when the buffer is full the policy decides what to drop.
+func (b *Bus) Subscribe(size int, policy Policy, kinds ...Kind) *Subscription {
+	if b == nil {
+		// nothing is ever published on a bus of its own
+		b = NewBus()
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	out := make(chan Event)
+	sub := &Subscription{
+		C:      out,
+		bus:    b,
+		kinds:  kinds,
+		size:   size,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	b.mutex.Lock()
+	b.subs[sub] = struct{}{}
+	b.mutex.Unlock()
+
+	go sub.deliver(out)
+
+	return sub
+}
+
+// Subscription receives events from a bus.
+type Subscription struct {
+	// C delivers the events in the order they were published
+	C <-chan Event
+
+	bus    *Bus
+	kinds  []Kind
+	size   int
+	policy Policy
+
+	mutex    sync.Mutex
+	queue    []Event
+	dropped  int64
+	draining bool
+
+	ready     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Dropped tells how many events this subscription has lost to a full buffer.
+func (s *Subscription) Dropped() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.dropped
+}
+
+// Close stops delivery and closes C, queued events are discarded.
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() {
+		s.bus.mutex.Lock()
+		delete(s.bus.subs, s)
+		s.bus.mutex.Unlock()
+		close(s.done)
+	})
+}
+
+// Drain stops new events from being queued, and closes C once
+// all queued events have been delivered.
+func (s *Subscription) Drain() {
+	s.bus.mutex.Lock()
+	delete(s.bus.subs, s)
+	s.bus.mutex.Unlock()
+
+	s.mutex.Lock()
+	s.draining = true
+	s.mutex.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+		// the delivery loop is already woken up
+	}
+}
+
+func (s *Subscription) wants(kind Kind) bool {
+	if len(s.kinds) == 0 {
+		return true
+	}
+	for _, k := range s.kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Subscription) push(e Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.policy == Coalesce {
+		for i, queued := range s.queue {
+			if queued.Kind == e.Kind {
+				copy(s.queue[i:], s.queue[i+1:])
+				s.queue[len(s.queue)-1] = e
+				s.dropped++
+				return
+			}
+		}
+	}
+
+	if s.size <= len(s.queue) {
+		s.dropped++
+		if s.policy == DropNewest {
+			return
+		}
+		s.queue = s.queue[1:]
+	}
+	s.queue = append(s.queue, e)
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+		// the delivery loop is already woken up
+	}
+}
+
+// pop also tells if the subscription is drained
+func (s *Subscription) pop() (Event, bool, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.queue) == 0 {
+		return Event{}, false, s.draining
+	}
+	e := s.queue[0]
+	s.queue = s.queue[1:]
+	return e, true, false
+}
+
+// deliver moves queued events to the subscriber until the subscription is closed
+func (s *Subscription) deliver(out chan<- Event) {
+	defer close(out)
+	for {
+		e, ok, drained := s.pop()
+		if drained {
+			return
+		}
+		if !ok {
+			select {
+			case <-s.ready:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		select {
+		case out <- e:
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func clicks(teamID string, count int64) Event {
+	return Event{Kind: ClicksRecorded, TeamID: teamID, Count: count}
+}
+
+func leader(teamID string) Event {
+	return Event{Kind: LeaderChanged, TeamID: teamID}
+}
+
+// receive reads from the subscription until C is closed
+func receive(t *testing.T, sub *Subscription) []Event {
+	t.Helper()
+	var got []Event
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				return got
+			}
+			got = append(got, e)
+		case <-timeout:
+			t.Fatalf("C was not closed, received %v", got)
+		}
+	}
+}
+
+func TestFullBuffer(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		publish []Event
+		want    []Event
+		dropped int64
+	}{
+		{
+			name:    "drop newest",
+			policy:  DropNewest,
+			publish: []Event{clicks("a", 1), clicks("b", 2), clicks("c", 3), clicks("d", 4)},
+			want:    []Event{clicks("a", 1), clicks("b", 2), clicks("c", 3)},
+			dropped: 1,
+		},
+		{
+			name:    "drop oldest",
+			policy:  DropOldest,
+			publish: []Event{clicks("a", 1), clicks("b", 2), clicks("c", 3), clicks("d", 4)},
+			want:    []Event{clicks("b", 2), clicks("c", 3), clicks("d", 4)},
+			dropped: 1,
+		},
+		{
+			name:    "coalesce",
+			policy:  Coalesce,
+			publish: []Event{clicks("a", 1), leader("a"), clicks("b", 2), leader("b"), clicks("c", 3)},
+			want:    []Event{leader("b"), clicks("c", 3)},
+			dropped: 3,
+		},
+		{
+			name:    "coalesce when full",
+			policy:  Coalesce,
+			publish: []Event{clicks("a", 1), leader("a"), {Kind: TeamCreated, TeamID: "b"}, {Kind: TeamChanged, TeamID: "a"}},
+			want:    []Event{leader("a"), {Kind: TeamCreated, TeamID: "b"}, {Kind: TeamChanged, TeamID: "a"}},
+			dropped: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		// without a delivery loop, everything stays queued
+		sub := &Subscription{size: 3, policy: tt.policy, ready: make(chan struct{}, 1)}
+		for _, e := range tt.publish {
+			sub.push(e)
+		}
+		if !reflect.DeepEqual(sub.queue, tt.want) {
+			t.Errorf("%s: queued %v, want %v", tt.name, sub.queue, tt.want)
+		}
+		if sub.Dropped() != tt.dropped {
+			t.Errorf("%s: dropped %d, want %d", tt.name, sub.Dropped(), tt.dropped)
+		}
+	}
+}
+
+func TestKinds(t *testing.T) {
+	bus := NewBus()
+	sub := bus.Subscribe(10, DropNewest, LeaderChanged)
+
+	bus.Publish(clicks("a", 1))
+	bus.Publish(leader("a"))
+	bus.Publish(clicks("b", 1))
+	sub.Drain()
+
+	if got, want := receive(t, sub), []Event{leader("a")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("received %v, want %v", got, want)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	bus := NewBus()
+	sub := bus.Subscribe(10, DropNewest)
+
+	published := []Event{clicks("a", 1), leader("a"), clicks("b", 2)}
+	for _, e := range published {
+		bus.Publish(e)
+	}
+	sub.Drain()
+	// a drained subscription gets nothing new
+	bus.Publish(clicks("c", 3))
+
+	if got := receive(t, sub); !reflect.DeepEqual(got, published) {
+		t.Errorf("received %v, want %v", got, published)
+	}
+}
+
+func TestClose(t *testing.T) {
+	bus := NewBus()
+	sub := bus.Subscribe(10, DropNewest)
+
+	for i := 0; i < 5; i++ {
+		bus.Publish(clicks("a", 1))
+	}
+	sub.Close()
+	sub.Close()
+	bus.Publish(clicks("a", 1))
+
+	// at most the event being delivered when closing gets through
+	if got := receive(t, sub); 1 < len(got) {
+		t.Errorf("received %v after closing", got)
+	}
+	if len(bus.subs) != 0 {
+		t.Errorf("the bus still has %d subscriptions", len(bus.subs))
+	}
+}
+
+func TestNilBus(t *testing.T) {
+	var bus *Bus
+	sub := bus.Subscribe(1, Coalesce)
+	bus.Publish(clicks("a", 1))
+	sub.Drain()
+
+	if got := receive(t, sub); len(got) != 0 {
+		t.Errorf("received %v from a nil bus", got)
+	}
+}
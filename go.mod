@@ -5,11 +5,18 @@ go 1.16
 require (
 	github.com/didip/tollbooth v4.0.2+incompatible
 	github.com/fabjan/psa v0.0.0-20210521135331-cca70e8eda04
+	github.com/felixge/httpsnoop v1.0.1
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
+	github.com/jackc/pgconn v1.8.1
 	github.com/jackc/pgx/v4 v4.11.0
+	github.com/mattn/go-sqlite3 v1.14.8
 	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
+	github.com/prometheus/client_golang v1.11.0
 	github.com/rs/cors v1.7.0
 	github.com/uptrace/uptrace-go v0.20.0
 	go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux v0.20.0
 	go.uber.org/ratelimit v0.2.0
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
+	gopkg.in/yaml.v3 v3.0.1
 )
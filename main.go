@@ -17,73 +17,78 @@ package main
 import (
 	"context"
 	_ "embed" // for embedding app version
-	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/didip/tollbooth"
 	"github.com/didip/tollbooth/limiter"
-	"github.com/gorilla/mux"
-	"github.com/rs/cors"
 	"github.com/uptrace/uptrace-go/uptrace"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 
+	"github.com/fabjan/mmocg/cheat"
+	"github.com/fabjan/mmocg/config"
+	"github.com/fabjan/mmocg/events"
+	"github.com/fabjan/mmocg/metrics"
+	"github.com/fabjan/mmocg/season"
 	"github.com/fabjan/mmocg/server"
 	"github.com/fabjan/mmocg/spam"
 	"github.com/fabjan/mmocg/store"
 )
 
-type appConfig struct {
-	port           int
-	allowedOrigins stringSlice
-	secrets        appSecrets
-}
-
-type appSecrets struct {
-	uptraceDSN  string
-	databaseURL string
+// logConfig tells what the server is about to do, without any secrets.
+func logConfig(cfg config.Config, seasons []server.Season, journal *store.JournalOptions) {
+	log.Printf("\tAPI port: %d", cfg.Port)
+	log.Printf("\tAllowed origins: [%s]", strings.Join(cfg.AllowOrigins, ", "))
+	log.Printf("\tClient IP from: [%s]", strings.Join(cfg.ClientIP.Lookups, ", "))
+	log.Printf("\tSeasons: %d", len(seasons))
+	if journal != nil {
+		log.Printf("\tJournal: %s (sync %s)", journal.Dir, journal.Sync)
+	}
+	if cfg.ClickBatch > 0 {
+		log.Printf("\tClick batches: %s", cfg.ClickBatch)
+	}
+	if cfg.Secrets.UptraceDSN != "" {
+		log.Printf("\tUptrace DSN configured")
+	}
+	if cfg.Secrets.DatabaseURL != "" {
+		log.Printf("\tDatabase URL configured")
+	}
 }
 
-func (cfg *appConfig) importEnv() {
-	envPort := os.Getenv("PORT")
-	port, err := strconv.Atoi(envPort)
+// printConfig writes the effective configuration, with secrets redacted.
+func printConfig(cfg config.Config) {
+	data, err := cfg.Redacted().YAML()
 	if err != nil {
-		port = 5000
+		log.Fatalf("cannot encode config: %v", err)
 	}
-	cfg.port = port
-	log.Printf("\tAPI port: %d", cfg.port)
+	os.Stdout.Write(data)
 }
 
-func (cfg *appConfig) importArgs() {
-
-	var flagAllowOrigins stringSlice
-	flag.Var(&flagAllowOrigins, "allow-origin", "Patterns to allow as origin in CORS.")
-
-	flag.Parse()
-
-	cfg.allowedOrigins = flagAllowOrigins
-
-	log.Printf("\tAllowed origins: %s", cfg.allowedOrigins.String())
-}
+// migrate brings the database schema up to date, so it can be done before
+// the new version is deployed.
+func migrate(cfg config.Config) {
+	if cfg.Secrets.DatabaseURL == "" || strings.HasPrefix(cfg.Secrets.DatabaseURL, store.SQLiteScheme) {
+		log.Fatalf("migrations need a Postgres DATABASE_URL")
+	}
 
-func (cfg *appConfig) importSecrets() {
-	// TODO secrets handling
-	dsn := os.Getenv("UPTRACE_DSN")
-	if dsn != "" {
-		cfg.secrets.uptraceDSN = dsn
-		log.Printf("\tUptrace DSN configured")
+	db, err := store.OpenPg(cfg.Secrets.DatabaseURL)
+	if err != nil {
+		log.Fatalf("cannot open database connection %v", err)
 	}
+	defer db.Close()
 
-	url := os.Getenv("DATABASE_URL")
-	if url != "" {
-		cfg.secrets.databaseURL = url
-		log.Printf("\tDatabase URL configured")
+	from, to, err := store.MigratePostgres(context.Background(), db, "teams")
+	if err != nil {
+		log.Fatalf("migration failed: %v", err)
 	}
+	log.Printf("Schema is at version %d (was %d)", to, from)
 }
 
 //go:embed VERSION
@@ -95,92 +100,335 @@ func main() {
 
 	log.Printf("Server version " + appVersion + " booting up...")
 
-	var cfg appConfig
-
 	log.Printf("Reading config...")
 
-	cfg.importEnv()
-	cfg.importArgs()
-	cfg.importSecrets()
+	cfg, args, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	seasons, _ := cfg.ParseSeasons()
+	journal, _ := cfg.JournalOptions()
+
+	switch strings.Join(args, " ") {
+	case "":
+	case "migrate":
+		migrate(cfg)
+		return
+	case "config print":
+		printConfig(cfg)
+		return
+	default:
+		log.Fatalf("unknown command %q", strings.Join(args, " "))
+	}
+
+	logConfig(cfg, seasons, journal)
+
+	live := config.NewRuntime(cfg, func() (config.Config, error) {
+		cfg, _, err := config.Load(os.Args[1:])
+		return cfg, err
+	})
+
+	server.MaxLeaderboardSize = cfg.Limits.LeaderboardSize
+	server.ClientIPLookups = cfg.ClientIP.Lookups
+	server.ForwardedForIndexFromBehind = cfg.ClientIP.Proxies - 1
 
 	log.Printf("Setting up tracing...")
-	ctx := context.Background()
 	uptrace.ConfigureOpentelemetry(&uptrace.Config{
 		ServiceName:    "mmocg",
 		ServiceVersion: appVersion,
-		DSN:            cfg.secrets.uptraceDSN,
+		DSN:            cfg.Secrets.UptraceDSN,
 	})
-	defer uptrace.Shutdown(ctx)
 
-	maxRPS := 10.0 // per token
-	lmtOpts := limiter.ExpirableOptions{DefaultExpirationTTL: time.Hour}
-	lmt := tollbooth.NewLimiter(maxRPS, &lmtOpts)
-	lmt.SetMessageContentType("text/plain; charset=utf-8")
-	lmt.SetMessage("Enhance your calm.")
+	var lmt liveLimiter
+	lmt.setRate(cfg.Limits.RequestsPerSecond)
 
-	onNewTeam := make(chan string)
-	onNewLeader := make(chan string)
+	bus := events.NewBus()
+	// events from all instances, the same as bus unless they share a database
+	cluster := bus
+	var announcing func() bool
 
 	log.Printf("Setting up store...")
 
 	var st server.Store
-	st = store.NewMutMap(onNewTeam, onNewLeader)
-	if cfg.secrets.databaseURL != "" {
-		db, err := store.OpenPg(cfg.secrets.databaseURL)
+	var backend string
+	if strings.HasPrefix(cfg.Secrets.DatabaseURL, store.SQLiteScheme) {
+		db, err := store.OpenSQLite(cfg.Secrets.DatabaseURL)
+		if err != nil {
+			log.Fatalf("cannot open database %v", err)
+		}
+		st, err = store.NewSQLite(db, "teams", bus)
+		if err != nil {
+			log.Fatalf("cannot initialize team store: %v", err)
+		}
+		backend = "sqlite"
+		log.Printf("\tUsing SQLite")
+	} else if cfg.Secrets.DatabaseURL != "" {
+		db, err := store.OpenPg(cfg.Secrets.DatabaseURL)
 		if err != nil {
 			log.Fatalf("cannot open database connection %v", err)
 		}
-		st, err = store.NewPostgres(db, "teams", onNewTeam, onNewLeader)
+		pg, err := store.NewPostgres(db, "teams", bus)
 		if err != nil {
 			log.Fatalf("cannot initialize team store: %v", err)
 		}
+		st = pg
+		if cfg.ClickBatch > 0 {
+			st = store.NewBatched(pg, cfg.ClickBatch, cfg.Limits.MaxClicksPerBatch)
+		}
+		cluster = events.NewBus()
+		fanOut := store.NewPgEvents(db, cfg.Secrets.DatabaseURL, "teams", bus, cluster)
+		announcing = fanOut.Leading
+		go fanOut.Go()
+		backend = "postgres"
 		log.Printf("\tUsing Postgres")
 	} else {
-		log.Printf("\tUsing in-memory map")
+		mm, err := store.NewMutMap(bus, journal)
+		if err != nil {
+			log.Fatalf("cannot initialize team store: %v", err)
+		}
+		st = mm
+		backend = "mutmap"
+		if journal != nil {
+			log.Printf("\tUsing in-memory map with journal")
+		} else {
+			log.Printf("\tUsing in-memory map")
+		}
 	}
-	defer st.Close()
+	st = store.NewInstrumented(st, backend)
+
+	log.Printf("Setting up audit trail...")
+
+	auditor := server.NewAuditor(st)
+
+	log.Printf("Setting up metrics...")
+
+	go metrics.Count(bus)
 
 	log.Printf("Setting up notification spammer...")
 
-	spammer := spam.NewHandler(onNewTeam, onNewLeader)
+	spammer := spam.NewHandler(cluster, announcing, cfg.Announcements.PerSecond)
 	go spammer.Go()
 
-	log.Printf("Creating API handlers...")
+	log.Printf("Loading banlist...")
+
+	bans := server.NewBanlist(st)
+	ctx, cancel := context.WithTimeout(context.Background(), server.StoreTimeout)
+	err = bans.Reload(ctx)
+	cancel()
+	if err != nil {
+		log.Fatalf("cannot load banlist: %v", err)
+	}
+
+	log.Printf("Setting up leaderboard stream...")
 
-	corsFilter := cors.New(cors.Options{
-		AllowedOrigins: cfg.allowedOrigins,
+	stream := server.NewLeaderboardStream(st, bans, cfg.Stream.PushesPerSecond)
+	go stream.Go()
+	go stream.Follow(cluster.Subscribe(1, events.Coalesce))
+	// the stream is refreshed again once the new bans are loaded
+	go bans.Follow(cluster.Subscribe(1, events.Coalesce, events.BansChanged), stream.Notify)
+
+	log.Printf("Setting up season schedule...")
+
+	scheduler, err := season.NewScheduler(st, seasons, func(s server.Season) {
+		auditor.Record(server.AuditEntry{Action: server.AuditEndSeason, Actor: server.ActorScheduler, Detail: s.ID})
+		stream.Notify()
 	})
+	if err != nil {
+		log.Fatalf("invalid season schedule: %v", err)
+	}
+	go scheduler.Go()
+
+	log.Printf("Setting up anti-cheat...")
+
+	var cheats *cheat.Detector
+	if opts := cfg.CheatOptions(); opts != nil {
+		cheats = cheat.NewDetector(*opts, func(f cheat.Flag) {
+			log.Printf("cheat: %s %s%s %v (strike %d)", f.Level, f.Source, f.TeamID, f.Reasons, f.Strikes)
+			auditor.Record(server.AuditEntry{
+				Action:   server.AuditFlag,
+				Actor:    server.ActorAntiCheat,
+				TeamID:   f.TeamID,
+				Count:    int64(f.Strikes),
+				Detail:   fmt.Sprintf("%s %v", f.Level, f.Reasons),
+				SourceIP: f.Source,
+			})
+		})
+		go cheats.Go()
+	} else {
+		log.Printf("\tAnti-cheat is disabled")
+	}
 
-	api := server.NewAPI(st)
+	log.Printf("Creating API handlers...")
+
+	settings := server.NewLiveSettings(apiSettings(cfg))
+
+	api := server.NewAPI(st, stream, settings, bans, auditor, cheats)
 
 	router := server.NewRouter(&api)
 	router.Use(otelmux.Middleware("mmocg-http"))
-	router.Use(limitMiddleware(lmt))
-	router.Use(corsFilter.Handler)
+	router.Use(lmt.middleware)
+	router.Use(settings.CORS)
+
+	live.Watch(func(cfg config.Config) {
+		lmt.setRate(cfg.Limits.RequestsPerSecond)
+		settings.Store(apiSettings(cfg))
+		spammer.SetRate(cfg.Announcements.PerSecond)
+	})
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			changes, err := live.Reload()
+			if err != nil {
+				log.Printf("config reload failed: %v", err)
+				continue
+			}
+			auditor.Record(server.AuditEntry{
+				Action: server.AuditReloadConfig,
+				Actor:  server.ActorSignal,
+				Detail: strings.Join(changes, ", "),
+			})
+		}
+	}()
+
+	// probes and scrapes are neither rate limited nor logged
+	health := server.NewHealth(st, announcing)
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", health.Healthz)
+	root.HandleFunc("/readyz", health.Readyz)
+	root.Handle("/metrics", metrics.Handler())
+	if cfg.Secrets.AdminToken != "" {
+		admin := server.NewAdmin(st, auditor, cheats, cfg.Secrets.AdminToken, live.Reload)
+		adminRouter := server.NewAdminRouter(admin)
+		adminRouter.Use(otelmux.Middleware("mmocg-admin"))
+		// moderators are few and slow, token guessers are not,
+		// so they are throttled before the token is even checked
+		var adminLmt liveLimiter
+		adminLmt.setRate(adminRequestsPerSecond)
+		root.Handle("/admin/", adminLmt.middleware(adminRouter))
+	}
+	root.Handle("/", router)
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Port),
+		Handler: root,
+	}
+	// streams and sockets never finish on their own
+	srv.RegisterOnShutdown(stream.Close)
+	srv.RegisterOnShutdown(api.CloseSockets)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	serving := make(chan error, 1)
+	go func() {
+		serving <- srv.ListenAndServe()
+	}()
 
 	log.Printf("Server is listening...")
 
-	addr := fmt.Sprintf(":%d", cfg.port)
-	log.Fatal(http.ListenAndServe(addr, router))
+	var failure error
+	select {
+	case failure = <-serving:
+		log.Printf("Server failed: %v", failure)
+	case sig := <-stop:
+		log.Printf("Received %v, shutting down...", sig)
+	}
+
+	shutdown(cfg.DrainTimeout, srv, &api, spammer, auditor, scheduler, st)
+
+	if failure != nil {
+		os.Exit(1)
+	}
 }
 
-type stringSlice []string
+// shutdown drains in-flight requests and sockets, stops the season schedule,
+// flushes pending store writes so their announcements are queued, drains the
+// announcements, writes the last of the audit trail, then closes the store
+// and the tracer.
+func shutdown(drainTimeout time.Duration, srv *http.Server, api *server.API, spammer *spam.Handler, auditor *server.Auditor, scheduler *season.Scheduler, st server.Store) {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	log.Printf("Draining requests...")
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		log.Printf("\tsome requests did not finish: %v", err)
+	}
+	// the sockets were closed when shutting down, their last clicks are still recorded
+	api.CloseSockets()
+
+	log.Printf("Stopping season schedule...")
+	// a season being ended is let finish, it is audited and announced like any other
+	scheduler.Stop()
+
+	log.Printf("Flushing store...")
+	err = st.Flush(ctx)
+	if err != nil {
+		log.Printf("\tsome writes were not flushed: %v", err)
+	}
+
+	log.Printf("Draining announcements...")
+	err = spammer.Shutdown(ctx)
+	if err != nil {
+		log.Printf("\tsome announcements were dropped: %v", err)
+	}
+
+	log.Printf("Writing audit trail...")
+	auditor.Close()
+
+	log.Printf("Closing store...")
+	st.Close()
+
+	log.Printf("Flushing traces...")
+	// the tracer gets its own deadline, even if draining took all of ours
+	tctx, tcancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer tcancel()
+	uptrace.Shutdown(tctx)
+
+	log.Printf("Server stopped")
+}
 
-func (s *stringSlice) String() string {
-	var sb strings.Builder
-	sb.WriteString("[")
-	sb.WriteString(strings.Join(*s, ", "))
-	sb.WriteString("]")
-	return fmt.Sprintf("%v", sb.String())
+func apiSettings(cfg config.Config) server.Settings {
+	return server.Settings{
+		MinCount:       cfg.Limits.MinClicks,
+		MaxCount:       cfg.Limits.MaxClicks,
+		AllowedOrigins: cfg.AllowOrigins,
+	}
 }
 
-func (s *stringSlice) Set(value string) error {
-	*s = append(*s, value)
-	return nil
+// adminRequestsPerSecond is the rate limit per client for the admin API,
+// it is kept apart from the (likely much higher) game rate limit.
+const adminRequestsPerSecond = 1.0
+
+// liveLimiter rate limits requests per client at a rate that can be changed.
+type liveLimiter struct {
+	current atomic.Value // *limiter.Limiter
 }
 
-func limitMiddleware(lmt *limiter.Limiter) mux.MiddlewareFunc {
-	return func(h http.Handler) http.Handler {
-		return tollbooth.LimitHandler(lmt, h)
+// setRate starts limiting at the given rate, if it has changed
+// all clients start over with full buckets.
+func (ll *liveLimiter) setRate(maxRPS float64) {
+	if lmt, ok := ll.current.Load().(*limiter.Limiter); ok && lmt.GetMax() == maxRPS {
+		return
 	}
+
+	lmtOpts := limiter.ExpirableOptions{DefaultExpirationTTL: time.Hour}
+	lmt := tollbooth.NewLimiter(maxRPS, &lmtOpts)
+	lmt.SetIPLookups(server.ClientIPLookups)
+	lmt.SetForwardedForIndexFromBehind(server.ForwardedForIndexFromBehind)
+	lmt.SetMessageContentType("text/plain; charset=utf-8")
+	lmt.SetMessage("Enhance your calm.")
+	lmt.SetOnLimitReached(func(w http.ResponseWriter, r *http.Request) {
+		metrics.RateLimited()
+	})
+	ll.current.Store(lmt)
+}
+
+func (ll *liveLimiter) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lmt := ll.current.Load().(*limiter.Limiter)
+		tollbooth.LimitHandler(lmt, h).ServeHTTP(w, r)
+	})
 }
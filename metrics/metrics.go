@@ -0,0 +1,129 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics keeps Prometheus metrics for the server.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/fabjan/mmocg/events"
+)
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mmocg_http_requests_total",
+		Help: "HTTP requests by route and status code.",
+	}, []string{"route", "code"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mmocg_http_request_duration_seconds",
+		Help:    "HTTP request latencies by route, streams last as long as the client stays.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+
+	rateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mmocg_http_rate_limited_total",
+		Help: "HTTP requests rejected by the rate limiter.",
+	})
+
+	clicks = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mmocg_clicks_total",
+		Help: "Clicks recorded by this instance.",
+	})
+
+	teamsCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mmocg_teams_created_total",
+		Help: "Teams created by this instance.",
+	})
+
+	leaderChanges = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mmocg_leader_changes_total",
+		Help: "Lead changes caused by this instance.",
+	})
+
+	announcements = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mmocg_announcements_total",
+		Help: "Announcements sent, by result.",
+	}, []string{"result"})
+
+	storeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mmocg_store_operation_duration_seconds",
+		Help:    "Store operation latencies by backend, operation and result.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend", "operation", "result"})
+)
+
+// eventBacklog is how many store events can wait to be counted.
+var eventBacklog = 10000
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Route counts requests to the named route, and measures their latency.
+func Route(inner http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := httpsnoop.CaptureMetrics(inner, w, r)
+		requests.WithLabelValues(name, strconv.Itoa(m.Code)).Inc()
+		requestDuration.WithLabelValues(name).Observe(m.Duration.Seconds())
+	})
+}
+
+// RateLimited counts a rejected request.
+func RateLimited() {
+	rateLimited.Inc()
+}
+
+// Announced counts an announcement, failed if err is not nil.
+func Announced(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	announcements.WithLabelValues(result).Inc()
+}
+
+// StoreOperation measures a store operation started at the given time.
+func StoreOperation(backend, operation string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	storeDuration.WithLabelValues(backend, operation, result).Observe(time.Since(start).Seconds())
+}
+
+// Count counts the store events published on the bus, it runs forever.
+// The bus should only carry the events of this instance, so nothing is counted twice.
+func Count(bus *events.Bus) {
+	sub := bus.Subscribe(eventBacklog, events.DropNewest)
+	for e := range sub.C {
+		switch e.Kind {
+		case events.ClicksRecorded:
+			clicks.Add(float64(e.Count))
+		case events.TeamCreated:
+			teamsCreated.Inc()
+		case events.LeaderChanged:
+			leaderChanges.Inc()
+		}
+	}
+}
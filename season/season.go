@@ -0,0 +1,167 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package season ends seasons on schedule.
+package season
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fabjan/mmocg/server"
+)
+
+// retryInterval is how long to wait before retrying a failed rollover.
+var retryInterval = time.Minute
+
+// Parse reads a season definition on the form "ID,START,END",
+// where START and END are RFC 3339 timestamps.
+func Parse(def string) (server.Season, error) {
+	season := server.Season{}
+
+	parts := strings.Split(def, ",")
+	if len(parts) != 3 {
+		return season, fmt.Errorf("season %q is not on the form ID,START,END", def)
+	}
+
+	season.ID = strings.TrimSpace(parts[0])
+	if season.ID == "" {
+		return season, fmt.Errorf("season %q has no ID", def)
+	}
+
+	var err error
+	season.Start, err = time.Parse(time.RFC3339, strings.TrimSpace(parts[1]))
+	if err != nil {
+		return season, fmt.Errorf("season %q has a bad start: %w", def, err)
+	}
+	season.End, err = time.Parse(time.RFC3339, strings.TrimSpace(parts[2]))
+	if err != nil {
+		return season, fmt.Errorf("season %q has a bad end: %w", def, err)
+	}
+
+	if !season.Start.Before(season.End) {
+		return season, fmt.Errorf("season %q ends before it starts", def)
+	}
+
+	return season, nil
+}
+
+// Scheduler ends seasons in a store when their time is up.
+//
+// Clicks between seasons count towards the next season.
+type Scheduler struct {
+	store    server.Store
+	schedule []server.Season
+	onEnd    func(server.Season)
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewScheduler creates a scheduler for the given seasons, which must not overlap.
+// The onEnd function (if any) is called after each season has ended.
+func NewScheduler(store server.Store, seasons []server.Season, onEnd func(server.Season)) (*Scheduler, error) {
+	schedule := make([]server.Season, len(seasons))
+	copy(schedule, seasons)
+	sort.Slice(schedule, func(i, j int) bool {
+		return schedule[i].Start.Before(schedule[j].Start)
+	})
+
+	for i := 1; i < len(schedule); i++ {
+		prev, next := schedule[i-1], schedule[i]
+		if prev.ID == next.ID {
+			return nil, fmt.Errorf("season %s is defined twice", next.ID)
+		}
+		if next.Start.Before(prev.End) {
+			return nil, fmt.Errorf("season %s overlaps season %s", next.ID, prev.ID)
+		}
+	}
+
+	return &Scheduler{
+		store:    store,
+		schedule: schedule,
+		onEnd:    onEnd,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Go ends each season at its end time, it returns when all seasons are over
+// or Stop is called. Seasons that should already have ended are ended right away.
+func (s *Scheduler) Go() {
+	defer close(s.done)
+	for _, season := range s.schedule {
+		if !s.wait(time.Until(season.End)) {
+			return
+		}
+		for !s.end(season) {
+			if !s.wait(retryInterval) {
+				return
+			}
+		}
+	}
+}
+
+// Stop stops the scheduler and waits for Go to return,
+// so no season is being ended once it has.
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+// wait tells if the time has passed without the scheduler being stopped
+func (s *Scheduler) wait(d time.Duration) bool {
+	select {
+	case <-s.stop:
+		return false
+	default:
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-s.stop:
+		return false
+	}
+}
+
+// end tells if the season is over, i.e. there is no need to retry
+func (s *Scheduler) end(season server.Season) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), server.StoreTimeout)
+	defer cancel()
+
+	err := s.store.EndSeason(ctx, season)
+	if errors.Is(err, server.ErrSeasonArchived) {
+		// already done, maybe by another instance or before a restart
+		return true
+	}
+	if err != nil {
+		log.Printf("failed to end season %s: %v", season.ID, err)
+		return false
+	}
+
+	log.Printf("season %s has ended", season.ID)
+	if s.onEnd != nil {
+		s.onEnd(season)
+	}
+
+	return true
+}
@@ -0,0 +1,452 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/fabjan/mmocg/cheat"
+	"github.com/fabjan/mmocg/emoji"
+)
+
+// Admin serves the operator API, every request must carry the admin token.
+type Admin struct {
+	store  Store
+	audit  *Auditor
+	cheats *cheat.Detector
+	token  string
+	reload func() ([]string, error)
+}
+
+// NewAdmin creates admin handlers moderating teams in the given store,
+// accepting the given bearer token. Every change is audited. Flags raised
+// by the cheat detector (if any) can be listed and pardoned. The reload
+// function re-reads the runtime settings and tells what changed.
+func NewAdmin(store Store, audit *Auditor, cheats *cheat.Detector, token string, reload func() ([]string, error)) *Admin {
+	return &Admin{store, audit, cheats, token, reload}
+}
+
+var defaultRecentLimit = 50
+
+var (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// authenticate rejects requests without the admin token.
+func (admin *Admin) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(admin.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ReloadConfig re-reads the configuration and applies the runtime settings.
+func (admin *Admin) ReloadConfig(w http.ResponseWriter, r *http.Request) {
+	changes, err := admin.reload()
+	if err != nil {
+		log.Printf("config reload failed: %v", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	admin.record(r, AuditEntry{Action: AuditReloadConfig, Detail: strings.Join(changes, ", ")})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetRecentTeams lists the most recently created teams, to look for offensive ones.
+func (admin *Admin) GetRecentTeams(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	limit, ok := intParam(r.URL.Query().Get("limit"), defaultRecentLimit)
+	if !ok || limit < 1 || MaxLeaderboardSize < limit {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	teams, err := admin.store.GetRecentTeams(ctx, limit)
+	if err != nil {
+		log.Printf("recent teams error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	setContentTypeJSON(w)
+	json.NewEncoder(w).Encode(teams)
+}
+
+// DeleteTeam removes a team and its clicks.
+func (admin *Admin) DeleteTeam(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	teamID, ok := moderatedTeamIDVar(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := admin.store.DeleteTeam(ctx, teamID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	admin.record(r, AuditEntry{Action: AuditDeleteTeam, TeamID: teamID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BanTeam bans an offensive team ID, with the reason in the "reason"
+// parameter, and deletes the team if it exists.
+func (admin *Admin) BanTeam(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	teamID, ok := teamIDVar(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// banned first, so the team can't be created again in between
+	ban := Ban{
+		BanRule:   BanRule{Match: BanExact, Value: teamID},
+		Reason:    r.URL.Query().Get("reason"),
+		CreatedAt: time.Now(),
+	}
+	err := admin.store.AddBan(ctx, ban)
+	if err != nil {
+		log.Printf("ban error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	admin.record(r, AuditEntry{Action: AuditBanTeam, TeamID: teamID, Detail: ban.Reason})
+
+	err = admin.store.DeleteTeam(ctx, teamID)
+	switch {
+	case err == nil:
+		admin.record(r, AuditEntry{Action: AuditDeleteTeam, TeamID: teamID})
+	case errors.Is(err, ErrNotFound):
+		// reserving an unused ID
+	default:
+		// the ban stands, banning again deletes the team
+		writeStoreError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RenameTeam gives a team the ID in the "to" parameter,
+// if that team already exists the two are merged.
+func (admin *Admin) RenameTeam(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	teamID, ok := moderatedTeamIDVar(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	newID, err := emoji.Normalize(r.URL.Query().Get("to"))
+	if err != nil || newID == teamID {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	team, err := admin.store.RenameTeam(ctx, teamID, newID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	admin.record(r, AuditEntry{Action: AuditRenameTeam, TeamID: teamID, Detail: "to " + newID})
+	setContentTypeJSON(w)
+	json.NewEncoder(w).Encode(team)
+}
+
+// ResetTeam takes away all clicks from a team.
+func (admin *Admin) ResetTeam(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	teamID, ok := moderatedTeamIDVar(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	team, err := admin.store.ResetTeam(ctx, teamID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	admin.record(r, AuditEntry{Action: AuditResetTeam, TeamID: teamID})
+	setContentTypeJSON(w)
+	json.NewEncoder(w).Encode(team)
+}
+
+// AdjustClicks adds the clicks in the "count" parameter to a team,
+// or takes them away if it is negative.
+func (admin *Admin) AdjustClicks(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	teamID, ok := moderatedTeamIDVar(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	count, err := strconv.ParseInt(r.URL.Query().Get("count"), 10, 64)
+	if err != nil || count == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	team, err := admin.store.AdjustClicks(ctx, teamID, count)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	admin.record(r, AuditEntry{Action: AuditAdjustClicks, TeamID: teamID, Count: count})
+	setContentTypeJSON(w)
+	json.NewEncoder(w).Encode(team)
+}
+
+// GetBans lists all bans, oldest first.
+func (admin *Admin) GetBans(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	bans, err := admin.store.GetBans(ctx)
+	if err != nil {
+		log.Printf("bans error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	setContentTypeJSON(w)
+	json.NewEncoder(w).Encode(bans)
+}
+
+// AddBan bans the team IDs matching the rule in the request body,
+// replacing the reason if the rule already exists.
+func (admin *Admin) AddBan(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	var ban Ban
+	err := json.NewDecoder(r.Body).Decode(&ban)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ban.BanRule, err = ban.Normalize()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ban.CreatedAt = time.Now()
+
+	err = admin.store.AddBan(ctx, ban)
+	if err != nil {
+		log.Printf("ban error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	admin.record(r, AuditEntry{Action: AuditAddBan, Detail: banDetail(ban)})
+	setContentTypeJSON(w)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ban)
+}
+
+// RemoveBan lifts the ban with the rule in the path.
+func (admin *Admin) RemoveBan(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	vars := mux.Vars(r)
+	rule, err := BanRule{Match: BanMatch(vars["match"]), Value: vars["value"]}.Normalize()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = admin.store.RemoveBan(ctx, rule)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	admin.record(r, AuditEntry{Action: AuditRemoveBan, Detail: banDetail(Ban{BanRule: rule})})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetAudit lists the newest entries in the audit trail, filtered by the
+// action, actor, team and ip parameters and the since and until times.
+func (admin *Admin) GetAudit(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	query := r.URL.Query()
+
+	filter := AuditFilter{
+		Action:   AuditAction(query.Get("action")),
+		Actor:    query.Get("actor"),
+		TeamID:   query.Get("team"),
+		SourceIP: query.Get("ip"),
+	}
+	if filter.TeamID != "" {
+		// teams are stored in canonical form, if they are emoji at all
+		if teamID, err := emoji.Normalize(filter.TeamID); err == nil {
+			filter.TeamID = teamID
+		}
+	}
+
+	var ok bool
+	filter.Limit, ok = intParam(query.Get("limit"), defaultAuditLimit)
+	if !ok || filter.Limit < 1 || maxAuditLimit < filter.Limit {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	filter.Since, ok = timeParam(query.Get("since"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	filter.Until, ok = timeParam(query.Get("until"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	entries, err := admin.store.GetAudit(ctx, filter)
+	if err != nil {
+		log.Printf("audit error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	setContentTypeJSON(w)
+	json.NewEncoder(w).Encode(entries)
+}
+
+// GetFlags lists the clients and teams suspected of cheating on this instance.
+func (admin *Admin) GetFlags(w http.ResponseWriter, r *http.Request) {
+	setContentTypeJSON(w)
+	json.NewEncoder(w).Encode(admin.cheats.Flags())
+}
+
+// PardonSource lifts the suspicion about the client in the path.
+func (admin *Admin) PardonSource(w http.ResponseWriter, r *http.Request) {
+	source := mux.Vars(r)["source"]
+	if !admin.cheats.PardonSource(source) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	admin.record(r, AuditEntry{Action: AuditPardon, Detail: "source " + source})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PardonTeam lifts the suspicion about the team in the path.
+func (admin *Admin) PardonTeam(w http.ResponseWriter, r *http.Request) {
+	teamID, ok := moderatedTeamIDVar(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !admin.cheats.PardonTeam(teamID) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	admin.record(r, AuditEntry{Action: AuditPardon, TeamID: teamID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// record logs what an admin did and adds it to the audit trail
+func (admin *Admin) record(r *http.Request, entry AuditEntry) {
+	entry.Actor = ActorAdmin
+	parts := []string{string(entry.Action)}
+	if entry.TeamID != "" {
+		parts = append(parts, entry.TeamID)
+	}
+	if entry.Count != 0 {
+		parts = append(parts, strconv.FormatInt(entry.Count, 10))
+	}
+	if entry.Detail != "" {
+		parts = append(parts, entry.Detail)
+	}
+	log.Printf("audit: %s (from %s)", strings.Join(parts, " "), sourceIP(r))
+	admin.audit.RecordRequest(r, entry)
+}
+
+func banDetail(ban Ban) string {
+	detail := fmt.Sprintf("%s %s", ban.Match, ban.Value)
+	if ban.Reason != "" {
+		detail += " (" + ban.Reason + ")"
+	}
+	return detail
+}
+
+// timeParam parses an RFC 3339 time parameter, empty is the zero time
+func timeParam(param string) (time.Time, bool) {
+	if param == "" {
+		return time.Time{}, true
+	}
+	t, err := time.Parse(time.RFC3339, param)
+	return t, err == nil
+}
+
+// moderatedTeamIDVar returns the team ID from the request path, normalized if
+// possible. Teams created before IDs were validated can still be moderated.
+func moderatedTeamIDVar(r *http.Request) (string, bool) {
+	teamID, ok := teamIDVar(r)
+	if ok {
+		return teamID, true
+	}
+	teamID = mux.Vars(r)["teamId"]
+	return teamID, teamID != ""
+}
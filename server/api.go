@@ -15,50 +15,129 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
+
+	"github.com/fabjan/mmocg/cheat"
+	"github.com/fabjan/mmocg/emoji"
 )
 
 // API uses a store to respond to API requests
 type API struct {
-	store Store
+	store    Store
+	stream   *LeaderboardStream
+	settings *LiveSettings
+	bans     *Banlist
+	audit    *Auditor
+	cheats   *cheat.Detector
+	sockets  *sockets
 }
 
-// NewAPI creates an API handler using the given store
-func NewAPI(store Store) API {
-	return API{store}
+// NewAPI creates an API handler using the given store,
+// notifying the stream (if any) about leaderboard changes.
+// The settings are read anew for every request, banned
+// teams (if any) can't be created, clicked or listed, and
+// created teams and clicks are audited (if there is an auditor).
+// Clicks from cheaters (if there is a detector) count less or not at all.
+func NewAPI(store Store, stream *LeaderboardStream, settings *LiveSettings, bans *Banlist, audit *Auditor, cheats *cheat.Detector) API {
+	return API{store, stream, settings, bans, audit, cheats, newSockets()}
 }
 
 // Store stores scores and teams
+//
+// Leaderboards only list teams with clicks, ordered by clicks and then by ID.
+// A team takes the lead when it has more clicks than the leader, a tie is not enough.
 type Store interface {
 	// error must mean the team ID is taken
-	CreateTeam(teamID string) (Team, error)
-	FindByID(teamID string) (Team, error)
-	GetLeaderboard() (Leaderboard, error)
-	RecordClicks(teamID string, count int64) (Team, error)
+	CreateTeam(ctx context.Context, teamID string) (Team, error)
+	// ErrNotFound means the team was not found
+	FindByID(ctx context.Context, teamID string) (Team, error)
+	GetLeaderboard(ctx context.Context) (Leaderboard, error)
+	// after (if not nil) is where the page starts, the offset is skipped from there
+	GetLeaderboardPage(ctx context.Context, after *Cursor, offset, limit int) (Leaderboard, error)
+	// ErrNotFound means the team was not found
+	GetLeaderboardAround(ctx context.Context, teamID string, n int) (Leaderboard, error)
+	// windows are at most a week long
+	GetWindowLeaderboard(ctx context.Context, window time.Duration, offset, limit int) (Leaderboard, error)
+	// ErrNotFound means the team was not found
+	GetStanding(ctx context.Context, teamID string) (Standing, error)
+	RecordClicks(ctx context.Context, teamID string, count int64) (Team, error)
+	// EndSeason archives the current standings and resets all clicks,
+	// ErrSeasonArchived means the season has already ended
+	EndSeason(ctx context.Context, season Season) error
+	// GetSeasons returns all ended seasons, oldest first
+	GetSeasons(ctx context.Context) ([]Season, error)
+	// ErrNotFound means the season was not found
+	GetSeasonLeaderboard(ctx context.Context, seasonID string) (Leaderboard, error)
+	// ErrNotFound means the team was not found
+	DeleteTeam(ctx context.Context, teamID string) error
+	// RenameTeam gives a team a new ID, if there already is a team with
+	// the new ID the clicks are merged into it. The team must be found,
+	// like for every other operation on one team.
+	RenameTeam(ctx context.Context, teamID, newID string) (Team, error)
+	// ResetTeam takes away all clicks from a team, it must be found
+	ResetTeam(ctx context.Context, teamID string) (Team, error)
+	// AdjustClicks adds clicks (or takes them away if count is negative)
+	// without them being played, no team gets less than zero clicks
+	AdjustClicks(ctx context.Context, teamID string, count int64) (Team, error)
+	// GetRecentTeams returns the most recently created teams, newest first
+	GetRecentTeams(ctx context.Context, limit int) ([]CreatedTeam, error)
+	// GetBans returns all bans, oldest first
+	GetBans(ctx context.Context) ([]Ban, error)
+	// AddBan adds a ban, replacing any ban with the same rule
+	AddBan(ctx context.Context, ban Ban) error
+	// ErrNotFound means the ban was not found
+	RemoveBan(ctx context.Context, rule BanRule) error
+	// RecordAudit appends entries to the audit trail
+	RecordAudit(ctx context.Context, entries []AuditEntry) error
+	// GetAudit returns the matching audit entries, newest first
+	GetAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+	// Flush writes whatever the store holds back, like batched clicks
+	Flush(ctx context.Context) error
+	// error must mean the store can't be used right now
+	Ping(ctx context.Context) error
 	Close()
 }
 
+// StoreTimeout limits how long a store operation may take.
+var StoreTimeout = 5 * time.Second
+
+// ErrSeasonArchived is returned when ending an already ended season.
+var ErrSeasonArchived = errors.New("season already archived")
+
+// ErrNotFound is returned by stores when a team, season or ban is not found.
+var ErrNotFound = errors.New("not found")
+
 // UpdateTeam creates or updates a team using the form data from the request
 func (api *API) UpdateTeam(w http.ResponseWriter, r *http.Request) {
 
-	teamID, ok := mux.Vars(r)["teamId"]
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	teamID, ok := teamIDVar(r)
 	if !ok {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	// TODO check if team name is really emoji, return 400 if not
-	// https://stackoverflow.com/questions/30757193/find-out-if-character-in-string-is-emoji/
+	if _, banned := api.bans.Banned(teamID); banned {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 
 	setContentTypeJSON(w)
 
-	team, err := api.store.CreateTeam(teamID)
+	team, err := api.store.CreateTeam(ctx, teamID)
 	if err == nil {
 		// this must mean the team was created
+		api.audit.RecordRequest(r, AuditEntry{Action: AuditCreateTeam, Actor: ActorPlayer, TeamID: teamID})
+		api.notifyStream()
 		w.WriteHeader(http.StatusCreated)
 	}
 
@@ -68,68 +147,365 @@ func (api *API) UpdateTeam(w http.ResponseWriter, r *http.Request) {
 // GetTeamByID returns a single team if found by ID
 func (api *API) GetTeamByID(w http.ResponseWriter, r *http.Request) {
 
-	teamID, ok := mux.Vars(r)["teamId"]
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	teamID, ok := teamIDVar(r)
 	if !ok {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	team, err := api.store.FindByID(teamID)
+	team, err := api.store.FindByID(ctx, teamID)
 	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if _, banned := api.bans.Banned(teamID); banned {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
 	setContentTypeJSON(w)
-	json.NewEncoder(w).Encode(team)
+	json.NewEncoder(w).Encode(api.withStanding(ctx, team))
+}
+
+// GetTeamRank returns the standing of a single team
+func (api *API) GetTeamRank(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	teamID, ok := teamIDVar(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	standing, err := api.store.GetStanding(ctx, teamID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if _, banned := api.bans.Banned(teamID); banned {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	setContentTypeJSON(w)
+	json.NewEncoder(w).Encode(standing)
 }
 
-// GetLeaderboard returns the highest scoring teams
+// MaxLeaderboardSize is the most teams listed in one leaderboard.
+var MaxLeaderboardSize = 640
+
+var defaultAroundLimit = 5
+
+// leaderboardWindows are the supported values of the window parameter
+var leaderboardWindows = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+}
+
+// GetLeaderboard returns the highest scoring teams, a page of them,
+// the teams around a given team, or the highest scoring recently
 func (api *API) GetLeaderboard(w http.ResponseWriter, r *http.Request) {
 
-	lb, err := api.store.GetLeaderboard()
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	query := r.URL.Query()
+
+	limit, ok := intParam(query.Get("limit"), MaxLeaderboardSize)
+	if !ok || limit < 1 || MaxLeaderboardSize < limit {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	offset, ok := intParam(query.Get("offset"), 0)
+	if !ok || offset < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var after *Cursor
+	if query.Get("cursor") != "" {
+		cursor, ok := ParseCursor(query.Get("cursor"))
+		if !ok || query.Get("window") != "" || query.Get("around") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		after = &cursor
+	}
+
+	var lb Leaderboard
+	var err error
+
+	if query.Get("window") != "" {
+		window, ok := leaderboardWindows[query.Get("window")]
+		if !ok || query.Get("around") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		skipped := 0
+		lb, _, err = api.visiblePage(offset, limit, func(skip, n int) (Leaderboard, error) {
+			page, err := api.store.GetWindowLeaderboard(ctx, window, skipped+skip, n)
+			skipped += skip + len(page)
+			return page, err
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	} else if query.Get("around") != "" {
+		teamID, err := emoji.Normalize(query.Get("around"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if query.Get("limit") == "" {
+			limit = defaultAroundLimit
+		}
+		lb, err = api.store.GetLeaderboardAround(ctx, teamID, limit)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if _, banned := api.bans.Banned(teamID); banned {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	} else {
+		var full bool
+		lb, full, err = api.visiblePage(offset, limit, func(skip, n int) (Leaderboard, error) {
+			page, err := api.store.GetLeaderboardPage(ctx, after, skip, n)
+			if 0 < len(page) {
+				cursor := CursorAfter(page)
+				after = &cursor
+			}
+			return page, err
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// a full page may be followed by more
+		if full {
+			w.Header().Set("X-Next-Cursor", CursorAfter(lb).String())
+		}
+	}
+
+	setContentTypeJSON(w)
+	json.NewEncoder(w).Encode(api.bans.Hide(lb))
+}
+
+// visiblePage returns at most limit teams that are not banned, skipping the
+// offset first of them, and tells if the page is full. The teams are fetched
+// in order by next, which skips and returns at most n of the teams after
+// those it returned before.
+func (api *API) visiblePage(offset, limit int, next func(skip, n int) (Leaderboard, error)) (Leaderboard, bool, error) {
+	if api.bans.Empty() {
+		lb, err := next(offset, limit)
+		return lb, len(lb) == limit, err
+	}
+
+	// banned teams are fetched too, so fetch more than needed
+	batch := offset + limit
+	if MaxLeaderboardSize < batch {
+		batch = MaxLeaderboardSize
+	}
+
+	page := Leaderboard{}
+	for {
+		lb, err := next(0, batch)
+		if err != nil {
+			return page, false, err
+		}
+		for _, team := range api.bans.Hide(lb) {
+			if 0 < offset {
+				offset--
+				continue
+			}
+			page = append(page, team)
+			if len(page) == limit {
+				return page, true, nil
+			}
+		}
+		if len(lb) < batch {
+			return page, false, nil
+		}
+	}
+}
+
+// StreamLeaderboard sends leaderboard updates as Server-Sent Events
+func (api *API) StreamLeaderboard(w http.ResponseWriter, r *http.Request) {
+
+	if api.stream == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	api.stream.ServeHTTP(w, r)
+}
+
+// GetSeasons returns all ended seasons
+func (api *API) GetSeasons(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	seasons, err := api.store.GetSeasons(ctx)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	setContentTypeJSON(w)
-	json.NewEncoder(w).Encode(lb)
+	json.NewEncoder(w).Encode(seasons)
 }
 
-var minCount = 1
-var maxCount = 10
+// GetSeasonLeaderboard returns the final standings of an ended season
+func (api *API) GetSeasonLeaderboard(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	seasonID, ok := mux.Vars(r)["seasonId"]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	lb, err := api.store.GetSeasonLeaderboard(ctx, seasonID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	setContentTypeJSON(w)
+	json.NewEncoder(w).Encode(lb)
+}
 
 // Click reports clicks for the given team
 func (api *API) Click(w http.ResponseWriter, r *http.Request) {
 
-	teamID, ok := mux.Vars(r)["teamId"]
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	teamID, ok := teamIDVar(r)
 	if !ok {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	if _, banned := api.bans.Banned(teamID); banned {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
 	countParam := r.URL.Query().Get("count")
 	if countParam == "" {
 		countParam = "1"
 	}
 
+	settings := api.settings.Load()
 	count, err := strconv.Atoi(countParam)
-	if err != nil || count < minCount || maxCount < count {
+	if err != nil || count < settings.MinCount || settings.MaxCount < count {
 		// TODO implement pay to win
 		w.WriteHeader(http.StatusPaymentRequired)
 		return
 	}
 
-	team, err := api.store.RecordClicks(teamID, int64(count))
+	team, err := api.recordClicks(ctx, sourceIP(r), teamID, count, count == settings.MaxCount)
 	if err != nil {
-		log.Printf("click error: %v", err)
-		w.WriteHeader(http.StatusNotFound)
+		writeStoreError(w, err)
 		return
 	}
 
 	setContentTypeJSON(w)
-	json.NewEncoder(w).Encode(team)
+	json.NewEncoder(w).Encode(api.withStanding(ctx, team))
+}
+
+// recordClicks records the clicks from the source that count, and returns
+// the team as stored so its clicks match its standing and the leaderboard.
+func (api *API) recordClicks(ctx context.Context, source, teamID string, count int, maxed bool) (Team, error) {
+	credit := api.cheats.Observe(source, teamID, count, maxed)
+	if credit == 0 {
+		return api.store.FindByID(ctx, teamID)
+	}
+
+	team, err := api.store.RecordClicks(ctx, teamID, credit)
+	if err != nil {
+		return team, err
+	}
+
+	api.audit.Clicks(source, teamID, credit)
+	api.notifyStream()
+
+	return team, nil
+}
+
+// storeContext is the request context with the store timeout
+func storeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), StoreTimeout)
+}
+
+// writeStoreError responds to a failed store operation, only a missing
+// team (or season, or ban) is the client's fault
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Printf("store timed out: %v", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
+		log.Printf("store error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// withStanding adds the current standing to the team, if it can be found
+func (api *API) withStanding(ctx context.Context, team Team) Team {
+	standing, err := api.store.GetStanding(ctx, team.ID)
+	if err != nil {
+		log.Printf("standing error: %v", err)
+		return team
+	}
+	return team.WithStanding(standing)
+}
+
+func (api *API) notifyStream() {
+	if api.stream != nil {
+		api.stream.Notify()
+	}
+}
+
+// teamIDVar returns the normalized team ID from the request path,
+// not ok means it is missing or not emoji.
+func teamIDVar(r *http.Request) (string, bool) {
+	teamID, ok := mux.Vars(r)["teamId"]
+	if !ok {
+		return "", false
+	}
+	teamID, err := emoji.Normalize(teamID)
+	if err != nil {
+		return "", false
+	}
+	return teamID, true
+}
+
+// intParam parses an integer query parameter, using the default if empty
+func intParam(param string, def int) (int, bool) {
+	if param == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
 }
 
 func setContentTypeJSON(w http.ResponseWriter) {
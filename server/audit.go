@@ -0,0 +1,165 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AuditInterval is how often the clicks added up for the audit trail are written.
+var AuditInterval = time.Minute
+
+// Auditor writes the audit trail to the store.
+//
+// Clicks are too many to write one by one, they are added up per team
+// and source and written every AuditInterval. A nil Auditor records nothing.
+type Auditor struct {
+	store Store
+
+	mutex  sync.Mutex
+	clicks map[clickSource]clickTally
+
+	done       chan struct{}
+	background sync.WaitGroup
+}
+
+type clickSource struct {
+	teamID   string
+	sourceIP string
+}
+
+type clickTally struct {
+	count    int64
+	requests int64
+}
+
+// NewAuditor creates an auditor writing to the store, Close
+// must be called to write the last clicks.
+func NewAuditor(store Store) *Auditor {
+	a := Auditor{
+		store:  store,
+		clicks: make(map[clickSource]clickTally),
+		done:   make(chan struct{}),
+	}
+
+	a.background.Add(1)
+	go a.run()
+
+	return &a
+}
+
+// Close writes all clicks not yet in the audit trail.
+func (a *Auditor) Close() {
+	if a == nil {
+		return
+	}
+	close(a.done)
+	a.background.Wait()
+	a.flush()
+}
+
+func (a *Auditor) run() {
+	defer a.background.Done()
+
+	ticker := time.NewTicker(AuditInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.done:
+			return
+		}
+		a.flush()
+	}
+}
+
+// Record writes an entry to the audit trail, made now unless it has a time.
+// The operation has already happened, so failures are only logged.
+func (a *Auditor) Record(entry AuditEntry) {
+	if a == nil {
+		return
+	}
+	if entry.At.IsZero() {
+		entry.At = time.Now()
+	}
+	a.write([]AuditEntry{entry})
+}
+
+// RecordRequest writes an entry for an operation done by the request,
+// with the source and ID of the request.
+func (a *Auditor) RecordRequest(r *http.Request, entry AuditEntry) {
+	entry.SourceIP = sourceIP(r)
+	entry.RequestID = RequestIDFrom(r.Context())
+	a.Record(entry)
+}
+
+// Clicks adds clicks from the source to the next audit entry for the team.
+func (a *Auditor) Clicks(sourceIP, teamID string, count int64) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	source := clickSource{teamID, sourceIP}
+	tally := a.clicks[source]
+	tally.count += count
+	tally.requests++
+	a.clicks[source] = tally
+}
+
+// flush writes the clicks added up since the last flush
+func (a *Auditor) flush() {
+	a.mutex.Lock()
+	clicks := a.clicks
+	a.clicks = make(map[clickSource]clickTally)
+	a.mutex.Unlock()
+
+	if len(clicks) == 0 {
+		return
+	}
+
+	now := time.Now()
+	entries := make([]AuditEntry, 0, len(clicks))
+	for source, tally := range clicks {
+		entries = append(entries, AuditEntry{
+			At:       now,
+			Action:   AuditClicks,
+			Actor:    ActorPlayer,
+			TeamID:   source.teamID,
+			Count:    tally.count,
+			Detail:   fmt.Sprintf("%d requests", tally.requests),
+			SourceIP: source.sourceIP,
+		})
+	}
+	a.write(entries)
+}
+
+func (a *Auditor) write(entries []AuditEntry) {
+	// the request that caused the entry might be gone already
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+
+	err := a.store.RecordAudit(ctx, entries)
+	if err != nil {
+		log.Printf("can't write %d audit entries: %v", len(entries), err)
+	}
+}
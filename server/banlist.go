@@ -0,0 +1,132 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fabjan/mmocg/emoji"
+	"github.com/fabjan/mmocg/events"
+)
+
+// Normalize checks that the rule can match something,
+// and returns it with the value in canonical form.
+func (rule BanRule) Normalize() (BanRule, error) {
+	switch rule.Match {
+	case BanExact, BanContains:
+		value, err := emoji.Normalize(rule.Value)
+		if err != nil {
+			return rule, fmt.Errorf("invalid %s ban: %w", rule.Match, err)
+		}
+		rule.Value = value
+	case BanCategory:
+		_, err := emoji.ParseCategory(rule.Value)
+		if err != nil {
+			return rule, err
+		}
+	default:
+		return rule, fmt.Errorf("unknown ban match %q", rule.Match)
+	}
+	return rule, nil
+}
+
+// Matches reports whether the rule matches the normalized team ID.
+func (rule BanRule) Matches(teamID string) bool {
+	switch rule.Match {
+	case BanExact:
+		return teamID == rule.Value
+	case BanContains:
+		return strings.Contains(teamID, rule.Value)
+	case BanCategory:
+		return emoji.InCategory(teamID, emoji.Category(rule.Value))
+	}
+	return false
+}
+
+// Banlist keeps the bans from the store at hand, so they don't have to
+// be read on every request. A nil Banlist bans nothing.
+type Banlist struct {
+	store Store
+	bans  atomic.Value // []Ban
+}
+
+// NewBanlist creates an empty banlist for the store, Reload fills it.
+func NewBanlist(store Store) *Banlist {
+	bl := &Banlist{store: store}
+	bl.bans.Store([]Ban(nil))
+	return bl
+}
+
+// Reload reads all bans from the store.
+func (bl *Banlist) Reload(ctx context.Context) error {
+	bans, err := bl.store.GetBans(ctx)
+	if err != nil {
+		return err
+	}
+	bl.bans.Store(bans)
+	return nil
+}
+
+// Follow reloads the bans on every event on the subscription, then calls
+// changed. It runs until the subscription is closed.
+func (bl *Banlist) Follow(sub *events.Subscription, changed func()) {
+	for range sub.C {
+		ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+		err := bl.Reload(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("banlist reload failed: %v", err)
+			continue
+		}
+		changed()
+	}
+}
+
+// Banned returns the first ban matching the normalized team ID, if any.
+func (bl *Banlist) Banned(teamID string) (Ban, bool) {
+	if bl == nil {
+		return Ban{}, false
+	}
+	for _, ban := range bl.bans.Load().([]Ban) {
+		if ban.Matches(teamID) {
+			return ban, true
+		}
+	}
+	return Ban{}, false
+}
+
+// Empty tells if no team is banned.
+func (bl *Banlist) Empty() bool {
+	return bl == nil || len(bl.bans.Load().([]Ban)) == 0
+}
+
+// Hide leaves banned teams out of the leaderboard. The teams still count
+// when ranking the others, so ranks can be skipped.
+func (bl *Banlist) Hide(lb Leaderboard) Leaderboard {
+	if bl.Empty() {
+		return lb
+	}
+	visible := make(Leaderboard, 0, len(lb))
+	for _, team := range lb {
+		if _, banned := bl.Banned(team.ID); !banned {
+			visible = append(visible, team)
+		}
+	}
+	return visible
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Health answers liveness and readiness probes.
+type Health struct {
+	store      Store
+	announcing func() bool
+}
+
+// Readiness is the body of a readiness probe response.
+type Readiness struct {
+	Status string `json:"status"`
+	Store  string `json:"store"`
+	// Announcer is "local" when this instance announces on its own,
+	// or "leading" or "standby" when instances share the announcer
+	Announcer string `json:"announcer"`
+}
+
+// NewHealth creates probe handlers checking the given store. The announcing
+// function (if any) tells if this instance is the elected announcer.
+func NewHealth(store Store, announcing func() bool) *Health {
+	return &Health{store, announcing}
+}
+
+// Healthz tells that the process is alive.
+func (h *Health) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// Readyz tells if requests can be served, i.e. if the store can be reached.
+func (h *Health) Readyz(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	readiness := Readiness{
+		Status:    "ok",
+		Store:     "ok",
+		Announcer: "local",
+	}
+	if h.announcing != nil {
+		readiness.Announcer = "standby"
+		if h.announcing() {
+			readiness.Announcer = "leading"
+		}
+	}
+
+	status := http.StatusOK
+	err := h.store.Ping(ctx)
+	if err != nil {
+		log.Printf("readiness check failed: %v", err)
+		readiness.Status = "unavailable"
+		readiness.Store = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+
+	setContentTypeJSON(w)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(readiness)
+}
@@ -28,11 +28,12 @@ func Logger(inner http.Handler, name string) http.Handler {
 		inner.ServeHTTP(w, r)
 
 		log.Printf(
-			"%s %s %s %s",
+			"%s %s %s %s %s",
 			r.Method,
 			r.RequestURI,
 			name,
 			time.Since(start),
+			RequestIDFrom(r.Context()),
 		)
 	})
 }
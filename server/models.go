@@ -14,11 +14,185 @@
 
 package server
 
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
 // Team is a collection of players clicking things
 type Team struct {
 	ID     string `json:"id,omitempty"`
 	Clicks int64  `json:"clicks,omitempty"`
+	// Rank and ClicksToNextRank are only set for single team responses
+	Rank             int64 `json:"rank,omitempty"`
+	ClicksToNextRank int64 `json:"clicksToNextRank,omitempty"`
+}
+
+// Standing is the position of a team on the leaderboard.
+// Teams with the same amount of clicks share the same rank.
+type Standing struct {
+	Rank int64 `json:"rank"`
+	// ClicksToNextRank is how many clicks are needed to catch up
+	// with the closest team above, zero for the leader(s).
+	ClicksToNextRank int64 `json:"clicksToNextRank"`
+}
+
+// WithStanding returns a copy of the team with the standing fields set.
+func (t Team) WithStanding(s Standing) Team {
+	t.Rank = s.Rank
+	t.ClicksToNextRank = s.ClicksToNextRank
+	return t
+}
+
+// CreatedTeam is a team and when it was created.
+type CreatedTeam struct {
+	Team
+	CreatedAt time.Time `json:"createdAt"`
 }
 
 // Leaderboard is a collection of the highest scoring teams
 type Leaderboard []Team
+
+// Cursor is the place of the last team on a leaderboard page. The next
+// page starts right after it, even if teams above it gained clicks.
+type Cursor struct {
+	Clicks int64
+	TeamID string
+}
+
+// CursorAfter returns the cursor for the page after the leaderboard.
+func CursorAfter(lb Leaderboard) Cursor {
+	last := lb[len(lb)-1]
+	return Cursor{Clicks: last.Clicks, TeamID: last.ID}
+}
+
+// String encodes the cursor, it is opaque to clients.
+func (c Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.Clicks, 10) + ":" + c.TeamID))
+}
+
+// ParseCursor decodes a cursor from its String form.
+func ParseCursor(s string) (Cursor, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, false
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return Cursor{}, false
+	}
+	clicks, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Cursor{}, false
+	}
+	return Cursor{Clicks: clicks, TeamID: parts[1]}, true
+}
+
+// Season is a period of play, when it ends the standings are archived
+// and all teams start over from zero clicks.
+type Season struct {
+	ID    string    `json:"id"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// BanMatch tells how a ban is matched against team IDs.
+type BanMatch string
+
+// The ways to match team IDs.
+const (
+	// BanExact matches a single team ID.
+	BanExact BanMatch = "exact"
+	// BanContains matches every team ID containing the emoji,
+	// also as part of a ZWJ sequence.
+	BanContains BanMatch = "contains"
+	// BanCategory matches every team ID with an emoji in the category,
+	// the categories are those of the emoji package.
+	BanCategory BanMatch = "category"
+)
+
+// BanRule matches team IDs that can't be used.
+type BanRule struct {
+	Match BanMatch `json:"match"`
+	Value string   `json:"value"`
+}
+
+// Ban keeps matching teams from being created, clicked or listed.
+// Reserved IDs are banned too, with a reason saying so.
+type Ban struct {
+	BanRule
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// AuditAction is a kind of state-changing operation.
+type AuditAction string
+
+// The audited operations.
+const (
+	AuditCreateTeam   AuditAction = "createTeam"
+	AuditClicks       AuditAction = "clicks"
+	AuditEndSeason    AuditAction = "endSeason"
+	AuditReloadConfig AuditAction = "reloadConfig"
+	AuditDeleteTeam   AuditAction = "deleteTeam"
+	AuditBanTeam      AuditAction = "banTeam"
+	AuditRenameTeam   AuditAction = "renameTeam"
+	AuditResetTeam    AuditAction = "resetTeam"
+	AuditAdjustClicks AuditAction = "adjustClicks"
+	AuditAddBan       AuditAction = "addBan"
+	AuditRemoveBan    AuditAction = "removeBan"
+	AuditFlag         AuditAction = "flag"
+	AuditPardon       AuditAction = "pardon"
+)
+
+// The actors doing audited operations.
+const (
+	ActorPlayer    = "player"
+	ActorAdmin     = "admin"
+	ActorScheduler = "scheduler"
+	// ActorSignal is whoever sent the server a signal
+	ActorSignal = "signal"
+	// ActorAntiCheat is the cheat detector
+	ActorAntiCheat = "antiCheat"
+)
+
+// AuditEntry is one operation in the audit trail.
+//
+// Clicks are added up per team and source, so a clicks entry covers
+// many requests and has no request ID.
+type AuditEntry struct {
+	At        time.Time   `json:"at"`
+	Action    AuditAction `json:"action"`
+	Actor     string      `json:"actor"`
+	TeamID    string      `json:"team,omitempty"`
+	Count     int64       `json:"count,omitempty"`
+	Detail    string      `json:"detail,omitempty"`
+	SourceIP  string      `json:"sourceIp,omitempty"`
+	RequestID string      `json:"requestId,omitempty"`
+}
+
+// AuditFilter selects entries from the audit trail,
+// empty fields match every entry.
+type AuditFilter struct {
+	Action   AuditAction
+	Actor    string
+	TeamID   string
+	SourceIP string
+	// Since and Until bound when the entries were made, Until is exclusive
+	Since time.Time
+	Until time.Time
+	// Limit is the most entries returned
+	Limit int
+}
+
+// Matches reports whether the entry is selected by the filter, the limit aside.
+func (f AuditFilter) Matches(e AuditEntry) bool {
+	return (f.Action == "" || e.Action == f.Action) &&
+		(f.Actor == "" || e.Actor == f.Actor) &&
+		(f.TeamID == "" || e.TeamID == f.TeamID) &&
+		(f.SourceIP == "" || e.SourceIP == f.SourceIP) &&
+		(f.Since.IsZero() || !e.At.Before(f.Since)) &&
+		(f.Until.IsZero() || e.At.Before(f.Until))
+}
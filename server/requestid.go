@@ -0,0 +1,84 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"regexp"
+
+	"github.com/didip/tollbooth/libstring"
+)
+
+// RequestIDHeader carries the request ID, both ways.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// validRequestID is what we accept from clients (or a proxy in front of us),
+// anything else is replaced by a new ID.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestID gives every request an ID, keeping the one it came with if any.
+// The ID is sent back in the response headers.
+func RequestID(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		inner.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestIDFrom returns the ID given to the request by RequestID, if any.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ClientIPLookups are where the client IP is found, tried in order like the
+// rate limiter does: RemoteAddr, X-Forwarded-For or X-Real-IP. The headers
+// are easy to fake, so they can only be used behind a proxy setting them.
+var ClientIPLookups = []string{"RemoteAddr"}
+
+// ForwardedForIndexFromBehind picks the client in X-Forwarded-For, counting
+// from the end of the list, where the closest proxy added its client.
+var ForwardedForIndexFromBehind = 0
+
+// sourceIP is the address the request came from, as the rate limiter sees it.
+func sourceIP(r *http.Request) string {
+	ip := libstring.RemoteIP(ClientIPLookups, ForwardedForIndexFromBehind, r)
+	if ip != "" {
+		return ip
+	}
+	// none of the headers were set
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
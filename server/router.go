@@ -20,6 +20,8 @@ import (
 	"strings"
 
 	"github.com/gorilla/mux"
+
+	"github.com/fabjan/mmocg/metrics"
 )
 
 // Route maps a path pattern to a handler function.
@@ -35,11 +37,25 @@ type Routes []Route
 
 // NewRouter creates a router with routes for the MMOCG API
 func NewRouter(api *API) *mux.Router {
+	return newRouter(apiRoutes(api))
+}
+
+// NewAdminRouter creates a router with routes for the admin API,
+// only requests with the admin token are let through.
+func NewAdminRouter(admin *Admin) *mux.Router {
+	router := newRouter(adminRoutes(admin))
+	router.Use(admin.authenticate)
+	return router
+}
+
+func newRouter(routes Routes) *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
-	for _, route := range apiRoutes(api) {
+	for _, route := range routes {
 		var handler http.Handler
 		handler = route.HandlerFunc
 		handler = Logger(handler, route.Name)
+		handler = metrics.Route(handler, route.Name)
+		handler = RequestID(handler)
 
 		router.
 			Methods(route.Method).
@@ -75,6 +91,13 @@ func apiRoutes(api *API) Routes {
 			api.Click,
 		},
 
+		Route{
+			"ClickSocket",
+			strings.ToUpper("Get"),
+			"/v1/ws",
+			api.ClickSocket,
+		},
+
 		Route{
 			"GetLeaderboard",
 			strings.ToUpper("Get"),
@@ -82,6 +105,27 @@ func apiRoutes(api *API) Routes {
 			api.GetLeaderboard,
 		},
 
+		Route{
+			"StreamLeaderboard",
+			strings.ToUpper("Get"),
+			"/v1/leaderboard/stream",
+			api.StreamLeaderboard,
+		},
+
+		Route{
+			"GetSeasons",
+			strings.ToUpper("Get"),
+			"/v1/seasons",
+			api.GetSeasons,
+		},
+
+		Route{
+			"GetSeasonLeaderboard",
+			strings.ToUpper("Get"),
+			"/v1/seasons/{seasonId}/leaderboard",
+			api.GetSeasonLeaderboard,
+		},
+
 		Route{
 			"GetTeamById",
 			strings.ToUpper("Get"),
@@ -89,6 +133,13 @@ func apiRoutes(api *API) Routes {
 			api.GetTeamByID,
 		},
 
+		Route{
+			"GetTeamRank",
+			strings.ToUpper("Get"),
+			"/v1/team/{teamId}/rank",
+			api.GetTeamRank,
+		},
+
 		Route{
 			"UpdateTeam",
 			strings.ToUpper("Post"),
@@ -97,3 +148,105 @@ func apiRoutes(api *API) Routes {
 		},
 	}
 }
+
+func adminRoutes(admin *Admin) Routes {
+	return Routes{
+		Route{
+			"ReloadConfig",
+			strings.ToUpper("Post"),
+			"/admin/v1/config/reload",
+			admin.ReloadConfig,
+		},
+
+		Route{
+			"GetRecentTeams",
+			strings.ToUpper("Get"),
+			"/admin/v1/teams",
+			admin.GetRecentTeams,
+		},
+
+		Route{
+			"DeleteTeam",
+			strings.ToUpper("Delete"),
+			"/admin/v1/team/{teamId}",
+			admin.DeleteTeam,
+		},
+
+		Route{
+			"BanTeam",
+			strings.ToUpper("Post"),
+			"/admin/v1/team/{teamId}/ban",
+			admin.BanTeam,
+		},
+
+		Route{
+			"RenameTeam",
+			strings.ToUpper("Post"),
+			"/admin/v1/team/{teamId}/rename",
+			admin.RenameTeam,
+		},
+
+		Route{
+			"ResetTeam",
+			strings.ToUpper("Post"),
+			"/admin/v1/team/{teamId}/reset",
+			admin.ResetTeam,
+		},
+
+		Route{
+			"AdjustClicks",
+			strings.ToUpper("Post"),
+			"/admin/v1/team/{teamId}/clicks",
+			admin.AdjustClicks,
+		},
+
+		Route{
+			"GetBans",
+			strings.ToUpper("Get"),
+			"/admin/v1/bans",
+			admin.GetBans,
+		},
+
+		Route{
+			"AddBan",
+			strings.ToUpper("Post"),
+			"/admin/v1/bans",
+			admin.AddBan,
+		},
+
+		Route{
+			"RemoveBan",
+			strings.ToUpper("Delete"),
+			"/admin/v1/bans/{match}/{value}",
+			admin.RemoveBan,
+		},
+
+		Route{
+			"GetAudit",
+			strings.ToUpper("Get"),
+			"/admin/v1/audit",
+			admin.GetAudit,
+		},
+
+		Route{
+			"GetFlags",
+			strings.ToUpper("Get"),
+			"/admin/v1/flags",
+			admin.GetFlags,
+		},
+
+		Route{
+			"PardonSource",
+			strings.ToUpper("Delete"),
+			"/admin/v1/flags/sources/{source}",
+			admin.PardonSource,
+		},
+
+		Route{
+			"PardonTeam",
+			strings.ToUpper("Delete"),
+			"/admin/v1/flags/teams/{teamId}",
+			admin.PardonTeam,
+		},
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/rs/cors"
+)
+
+// Settings are the API settings that can change while the server runs.
+type Settings struct {
+	// MinCount and MaxCount bound the clicks reported at once
+	MinCount int
+	MaxCount int
+	// AllowedOrigins are checked by CORS and when opening WebSockets
+	AllowedOrigins []string
+}
+
+// LiveSettings holds the current settings, they are replaced atomically
+// so a request never sees half of an update.
+type LiveSettings struct {
+	value atomic.Value // liveState
+}
+
+type liveState struct {
+	Settings
+	cors *cors.Cors
+}
+
+// NewLiveSettings starts out with the given settings.
+func NewLiveSettings(settings Settings) *LiveSettings {
+	ls := &LiveSettings{}
+	ls.Store(settings)
+	return ls
+}
+
+// Load returns the current settings.
+func (ls *LiveSettings) Load() Settings {
+	return ls.state().Settings
+}
+
+// Store replaces the current settings.
+func (ls *LiveSettings) Store(settings Settings) {
+	ls.value.Store(liveState{
+		Settings: settings,
+		cors: cors.New(cors.Options{
+			AllowedOrigins: settings.AllowedOrigins,
+		}),
+	})
+}
+
+func (ls *LiveSettings) state() liveState {
+	return ls.value.Load().(liveState)
+}
+
+// CORS filters requests by the allowed origins at the time of the request.
+func (ls *LiveSettings) CORS(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ls.state().cors.ServeHTTP(w, r, h.ServeHTTP)
+	})
+}
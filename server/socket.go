@@ -0,0 +1,293 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+
+	"github.com/fabjan/mmocg/emoji"
+)
+
+// Click batches are limited per connection, like the HTTP API
+// is limited per client by the rate limiting middleware.
+var socketBatchesPerSecond = 10.0
+var socketBatchBurst = 10
+
+var (
+	socketPongWait   = 60 * time.Second
+	socketPingPeriod = socketPongWait / 2
+	socketWriteWait  = 10 * time.Second
+	socketReadLimit  = int64(1024)
+)
+
+// SocketMessage is sent by WebSocket clients.
+type SocketMessage struct {
+	// Type is "join" or "click"
+	Type   string `json:"type"`
+	TeamID string `json:"teamId,omitempty"`
+	Count  int    `json:"count,omitempty"`
+}
+
+// SocketReply is sent to WebSocket clients.
+type SocketReply struct {
+	// Type is "team" or "error"
+	Type     string `json:"type"`
+	Team     *Team  `json:"team,omitempty"`
+	Position int    `json:"position,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// sockets are the open WebSocket connections. The HTTP server neither
+// waits for nor closes them when shutting down, since they are hijacked.
+type sockets struct {
+	mutex  sync.Mutex
+	conns  map[*websocket.Conn]struct{}
+	closed bool
+	// open counts the handlers still running
+	open sync.WaitGroup
+}
+
+func newSockets() *sockets {
+	return &sockets{conns: make(map[*websocket.Conn]struct{})}
+}
+
+// add tracks the connection, it tells if the sockets are still open
+func (s *sockets) add(conn *websocket.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.open.Add(1)
+	return true
+}
+
+func (s *sockets) remove(conn *websocket.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.conns, conn)
+	s.open.Done()
+}
+
+// CloseSockets closes all WebSocket connections and refuses new ones,
+// then waits until their handlers are done recording clicks.
+// It is meant for shutting down, and can be called more than once.
+func (api *API) CloseSockets() {
+	api.sockets.mutex.Lock()
+	api.sockets.closed = true
+	for conn := range api.sockets.conns {
+		// a slow client must not hold up closing the others
+		go func(conn *websocket.Conn) {
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(socketWriteWait))
+			conn.Close()
+		}(conn)
+	}
+	api.sockets.mutex.Unlock()
+
+	api.sockets.open.Wait()
+}
+
+// ClickSocket lets a client join a team and stream clicks over a WebSocket.
+func (api *API) ClickSocket(w http.ResponseWriter, r *http.Request) {
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: api.checkOrigin,
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already responded with an error
+		return
+	}
+	defer conn.Close()
+
+	if !api.sockets.add(conn) {
+		return
+	}
+	defer api.sockets.remove(conn)
+
+	conn.SetReadLimit(socketReadLimit)
+	conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	go pingSocket(conn, done)
+
+	limiter := rate.NewLimiter(rate.Limit(socketBatchesPerSecond), socketBatchBurst)
+	teamID := ""
+
+	for {
+		var msg SocketMessage
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("socket read error: %v", err)
+			}
+			return
+		}
+
+		ctx, cancel := storeContext(r)
+
+		var reply SocketReply
+		switch msg.Type {
+		case "join":
+			teamID, reply = api.socketJoin(ctx, msg.TeamID)
+		case "click":
+			if !limiter.Allow() {
+				reply = socketError("Enhance your calm.")
+				break
+			}
+			reply = api.socketClick(ctx, sourceIP(r), teamID, msg.Count)
+		default:
+			reply = socketError("unknown message type")
+		}
+
+		cancel()
+
+		conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+		err = conn.WriteJSON(reply)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (api *API) socketJoin(ctx context.Context, rawTeamID string) (string, SocketReply) {
+	teamID, err := emoji.Normalize(rawTeamID)
+	if err != nil {
+		return "", socketError("invalid team ID")
+	}
+	if _, banned := api.bans.Banned(teamID); banned {
+		return "", socketError("team is banned")
+	}
+
+	team, err := api.store.FindByID(ctx, teamID)
+	if err != nil {
+		return "", storeSocketError(err)
+	}
+
+	return teamID, api.socketTeam(ctx, team)
+}
+
+func (api *API) socketClick(ctx context.Context, source, teamID string, count int) SocketReply {
+	if teamID == "" {
+		return socketError("join a team first")
+	}
+	settings := api.settings.Load()
+	if count < settings.MinCount || settings.MaxCount < count {
+		return socketError("invalid click count")
+	}
+	if _, banned := api.bans.Banned(teamID); banned {
+		return socketError("team is banned")
+	}
+
+	team, err := api.recordClicks(ctx, source, teamID, count, count == settings.MaxCount)
+	if err != nil {
+		log.Printf("socket click error: %v", err)
+		return storeSocketError(err)
+	}
+
+	return api.socketTeam(ctx, team)
+}
+
+func (api *API) socketTeam(ctx context.Context, team Team) SocketReply {
+	team = api.withStanding(ctx, team)
+	return SocketReply{
+		Type:     "team",
+		Team:     &team,
+		Position: int(team.Rank),
+	}
+}
+
+// storeSocketError tells the client if the team is missing, or else that
+// the click may be retried
+func storeSocketError(err error) SocketReply {
+	if errors.Is(err, ErrNotFound) {
+		return socketError("team not found")
+	}
+	return socketError("try again later")
+}
+
+func socketError(msg string) SocketReply {
+	return SocketReply{
+		Type:  "error",
+		Error: msg,
+	}
+}
+
+// pingSocket keeps the connection alive until done is closed.
+func pingSocket(conn *websocket.Conn, done chan struct{}) {
+	ticker := time.NewTicker(socketPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			deadline := time.Now().Add(socketWriteWait)
+			err := conn.WriteControl(websocket.PingMessage, nil, deadline)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// checkOrigin matches the Origin header against the allowed origin patterns
+// the same way as the CORS filter: no patterns allows everything and each
+// pattern may contain one "*" wildcard.
+func (api *API) checkOrigin(r *http.Request) bool {
+	allowedOrigins := api.settings.Load().AllowedOrigins
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(allowedOrigins) == 0 {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	for _, pattern := range allowedOrigins {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		i := strings.IndexByte(pattern, '*')
+		if i < 0 {
+			continue
+		}
+		prefix, suffix := pattern[:i], pattern[i+1:]
+		if len(prefix)+len(suffix) <= len(origin) &&
+			strings.HasPrefix(origin, prefix) &&
+			strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,219 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/ratelimit"
+
+	"github.com/fabjan/mmocg/events"
+)
+
+// keepAliveInterval is how often idle streams get a comment line,
+// so proxies don't time out the connection.
+var keepAliveInterval = 20 * time.Second
+
+// LeaderboardStream pushes leaderboard snapshots to Server-Sent Events clients.
+//
+// Changes are coalesced, the store is queried at most pushesPerSecond
+// times per second no matter how many clicks are reported.
+type LeaderboardStream struct {
+	store           Store
+	bans            *Banlist
+	pushesPerSecond int
+	changed         chan struct{}
+	closed          chan struct{}
+	closeOnce       sync.Once
+
+	// event IDs are prefixed by boot time so they don't repeat across restarts
+	idPrefix string
+
+	mutex       sync.RWMutex
+	seq         int64
+	lastID      string
+	lastData    []byte
+	subscribers map[chan struct{}]struct{}
+}
+
+// NewLeaderboardStream creates a stream reading leaderboards from the given store,
+// leaving out banned teams (if any).
+func NewLeaderboardStream(store Store, bans *Banlist, pushesPerSecond int) *LeaderboardStream {
+	return &LeaderboardStream{
+		store:           store,
+		bans:            bans,
+		pushesPerSecond: pushesPerSecond,
+		changed:         make(chan struct{}, 1),
+		closed:          make(chan struct{}),
+		idPrefix:        strconv.FormatInt(time.Now().Unix(), 36),
+		subscribers:     make(map[chan struct{}]struct{}),
+	}
+}
+
+// Notify tells the stream that the leaderboard might have changed.
+// It never blocks.
+func (ls *LeaderboardStream) Notify() {
+	select {
+	case ls.changed <- struct{}{}:
+	default:
+		// a refresh is already pending
+	}
+}
+
+// Close ends all client streams, so they don't hold up a server shutdown.
+// Clients are expected to reconnect (to another instance).
+func (ls *LeaderboardStream) Close() {
+	ls.closeOnce.Do(func() {
+		close(ls.closed)
+	})
+}
+
+// Follow notifies the stream of every event on the subscription,
+// it runs until the subscription is closed.
+func (ls *LeaderboardStream) Follow(sub *events.Subscription) {
+	for range sub.C {
+		ls.Notify()
+	}
+}
+
+// Go starts the refresh loop, it runs forever.
+func (ls *LeaderboardStream) Go() {
+	rl := ratelimit.New(ls.pushesPerSecond)
+	ls.Notify() // get an initial snapshot
+	for range ls.changed {
+		rl.Take()
+		ls.refresh()
+	}
+}
+
+func (ls *LeaderboardStream) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+
+	lb, err := ls.store.GetLeaderboard(ctx)
+	if err != nil {
+		log.Printf("leaderboard stream refresh failed: %v", err)
+		return
+	}
+	data, err := json.Marshal(ls.bans.Hide(lb))
+	if err != nil {
+		log.Printf("leaderboard stream encoding failed: %v", err)
+		return
+	}
+
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	if ls.lastData != nil && bytes.Equal(data, ls.lastData) {
+		return
+	}
+
+	ls.seq++
+	ls.lastID = fmt.Sprintf("%s-%d", ls.idPrefix, ls.seq)
+	ls.lastData = data
+
+	for sub := range ls.subscribers {
+		select {
+		case sub <- struct{}{}:
+		default:
+			// the subscriber has not caught up yet, it will get the latest data
+		}
+	}
+}
+
+func (ls *LeaderboardStream) subscribe() chan struct{} {
+	sub := make(chan struct{}, 1)
+	ls.mutex.Lock()
+	ls.subscribers[sub] = struct{}{}
+	ls.mutex.Unlock()
+	return sub
+}
+
+func (ls *LeaderboardStream) unsubscribe(sub chan struct{}) {
+	ls.mutex.Lock()
+	delete(ls.subscribers, sub)
+	ls.mutex.Unlock()
+}
+
+func (ls *LeaderboardStream) latest() (string, []byte) {
+	ls.mutex.RLock()
+	defer ls.mutex.RUnlock()
+	return ls.lastID, ls.lastData
+}
+
+// ServeHTTP streams leaderboard events until the client goes away.
+//
+// Every event carries the full leaderboard, so resuming with Last-Event-ID
+// only needs to skip the first event if the client already has it.
+func (ls *LeaderboardStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	select {
+	case <-ls.closed:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	sub := ls.subscribe()
+	defer ls.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sentID := r.Header.Get("Last-Event-ID")
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		id, data := ls.latest()
+		if data != nil && id != sentID {
+			_, err := fmt.Fprintf(w, "id: %s\nevent: leaderboard\ndata: %s\n\n", id, data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+			sentID = id
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ls.closed:
+			return
+		case <-sub:
+		case <-keepAlive.C:
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
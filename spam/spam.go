@@ -17,9 +17,13 @@ package spam
 
 import (
 	"bytes"
+	"context"
 	"html/template"
 	"log"
+	"sync/atomic"
 
+	"github.com/fabjan/mmocg/events"
+	"github.com/fabjan/mmocg/metrics"
 	psacfg "github.com/fabjan/psa/configure"
 	"go.uber.org/ratelimit"
 )
@@ -32,53 +36,100 @@ func renderAnnouncement(tmpl *template.Template, msg string) string {
 	return template.HTMLEscapeString(buf.String())
 }
 
+// challengerBacklog is how many new teams can wait for an announcement,
+// when more teams are created the latest ones are not announced.
+var challengerBacklog = 100
+
 // Handler listens for team updates and spams announcements.
 type Handler struct {
-	onNewTeam, onNewLeader chan string
-	cfg                    psacfg.AppConfig
-	spamPerSecond          int
+	challengers   *events.Subscription
+	leaders       *events.Subscription
+	cfg           psacfg.AppConfig
+	spamPerSecond int64 // accessed atomically
+	announcing    func() bool
+	done          chan struct{}
 }
 
-// NewHandler creates a new spam handler.
-func NewHandler(onNewTeam, onNewLeader chan string) *Handler {
+// NewHandler creates a new spam handler subscribing to the given bus,
+// announcing at most spamPerSecond times per second.
+// Events are only announced when announcing (if given) returns true,
+// so several instances can share one announcer.
+func NewHandler(bus *events.Bus, announcing func() bool, spamPerSecond int) *Handler {
 	cfg, err := psacfg.FromEnv()
 	if err != nil {
 		log.Fatalf("failed announcement config: %v", err)
 	}
 	return &Handler{
-		spamPerSecond: 1, // TODO make this configurable
-		onNewTeam:     onNewTeam,
-		onNewLeader:   onNewLeader,
+		spamPerSecond: int64(spamPerSecond),
+		challengers:   bus.Subscribe(challengerBacklog, events.DropNewest, events.TeamCreated),
+		leaders:       bus.Subscribe(1, events.Coalesce, events.LeaderChanged), // only the latest leader matters
 		cfg:           cfg,
+		announcing:    announcing,
+		done:          make(chan struct{}),
 	}
 }
 
-// Go starts the channel listener/spamming forever loop.
+// Go starts the channel listener/spamming loop,
+// it runs until Shutdown has drained the subscriptions.
 func (h *Handler) Go() {
-	// There are not really any resources to clean up,
-	// so this handler has no graceful shutdown.
-	rl := ratelimit.New(h.spamPerSecond)
+	defer close(h.done)
+	perSecond := atomic.LoadInt64(&h.spamPerSecond)
+	rl := ratelimit.New(int(perSecond))
 	announcers := h.cfg.Announcers()
 	tmpl := h.cfg.MessageTemplate
-	for {
-		rl.Take()
+	challengers := h.challengers.C
+	leaders := h.leaders.C
+	for challengers != nil || leaders != nil {
+		var msg string
 		select {
-		case challenger := <-h.onNewTeam:
-			msg := renderAnnouncement(tmpl, "A challenger appears! ("+challenger+")")
-			for _, a := range announcers {
-				err := a.Announce(msg)
-				if err != nil {
-					log.Printf("failed to send announcement: %v", err)
-				}
+		case challenger, ok := <-challengers:
+			if !ok {
+				challengers = nil
+				continue
+			}
+			msg = renderAnnouncement(tmpl, "A challenger appears! ("+challenger.TeamID+")")
+		case leader, ok := <-leaders:
+			if !ok {
+				leaders = nil
+				continue
 			}
-		case leader := <-h.onNewLeader:
-			msg := renderAnnouncement(tmpl, leader+" is in now the lead!")
-			for _, a := range announcers {
-				err := a.Announce(msg)
-				if err != nil {
-					log.Printf("failed to send announcement: %v", err)
-				}
+			msg = renderAnnouncement(tmpl, leader.TeamID+" is in now the lead!")
+		}
+		if h.announcing != nil && !h.announcing() {
+			// another instance announces this
+			continue
+		}
+		if changed := atomic.LoadInt64(&h.spamPerSecond); changed != perSecond {
+			perSecond = changed
+			rl = ratelimit.New(int(perSecond))
+		}
+		rl.Take()
+		for _, a := range announcers {
+			err := a.Announce(msg)
+			metrics.Announced(err)
+			if err != nil {
+				log.Printf("failed to send announcement: %v", err)
 			}
 		}
 	}
 }
+
+// SetRate changes how many announcements are made per second.
+func (h *Handler) SetRate(spamPerSecond int) {
+	atomic.StoreInt64(&h.spamPerSecond, int64(spamPerSecond))
+}
+
+// Shutdown stops listening for events and waits until the queued
+// announcements are sent. If the context ends first the rest are dropped.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	h.challengers.Drain()
+	h.leaders.Drain()
+	select {
+	case <-h.done:
+		return nil
+	case <-ctx.Done():
+		h.challengers.Close()
+		h.leaders.Close()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fabjan/mmocg/server"
+)
+
+// Batched is a Postgres store writing clicks behind.
+//
+// Clicks are added up per team in memory and flushed together every
+// interval, or as soon as enough clicks are waiting. Clicked teams are
+// returned with their score as it will be after the flush, which might
+// be a little off if other instances also click them.
+type Batched struct {
+	*Postgres
+	// writes go through the Postgres store, except in tests
+	writes    batchWriter
+	interval  time.Duration
+	maxClicks int64
+
+	mutex         sync.Mutex
+	pending       map[string]int64
+	pendingClicks int64
+	// flushing is the batch being written
+	flushing map[string]int64
+	// totals are the team scores as of their last flush
+	totals map[string]int64
+
+	// flushMutex makes flushes happen one at a time, and in order
+	flushMutex sync.Mutex
+	full       chan struct{}
+	done       chan struct{}
+	background sync.WaitGroup
+}
+
+// batchWriter is the part of the Postgres store that clicks are written through
+type batchWriter interface {
+	FindByID(ctx context.Context, teamID string) (server.Team, error)
+	recordClickBatch(ctx context.Context, teamIDs []string, counts []int64) (server.Leaderboard, error)
+	Close()
+}
+
+// closeFlushTimeout is how long Close keeps trying to flush the last clicks
+var closeFlushTimeout = 30 * time.Second
+
+// closeRetryInterval is how long Close waits between flushes
+var closeRetryInterval = time.Second
+
+// NewBatched wraps the Postgres store, flushing clicks every interval
+// or when maxClicks are waiting.
+func NewBatched(pg *Postgres, interval time.Duration, maxClicks int64) *Batched {
+	return newBatched(pg, pg, interval, maxClicks)
+}
+
+func newBatched(pg *Postgres, writes batchWriter, interval time.Duration, maxClicks int64) *Batched {
+	b := Batched{
+		Postgres:  pg,
+		writes:    writes,
+		interval:  interval,
+		maxClicks: maxClicks,
+		pending:   make(map[string]int64),
+		totals:    make(map[string]int64),
+		full:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+
+	b.background.Add(1)
+	go b.run()
+
+	return &b
+}
+
+// Close flushes all waiting clicks, then closes the Postgres store.
+// A failing flush is retried for a while before the clicks are dropped.
+func (b *Batched) Close() {
+	close(b.done)
+	b.background.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), closeFlushTimeout)
+	defer cancel()
+
+	err := b.retryFlush(ctx)
+	if err != nil {
+		b.mutex.Lock()
+		log.Printf("giving up flushing, %d clicks are lost: %v", b.pendingClicks, err)
+		b.mutex.Unlock()
+	}
+
+	b.writes.Close()
+}
+
+// retryFlush flushes until it succeeds or the context ends
+func (b *Batched) retryFlush(ctx context.Context) error {
+	for {
+		err := b.flush(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-time.After(closeRetryInterval):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// Flush writes all waiting clicks now.
+func (b *Batched) Flush(ctx context.Context) error {
+	return b.flush(ctx)
+}
+
+func (b *Batched) run() {
+	defer b.background.Done()
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.full:
+		case <-b.done:
+			return
+		}
+		b.flush(context.Background())
+	}
+}
+
+// RecordClicks adds clicks to the next batch.
+func (b *Batched) RecordClicks(ctx context.Context, teamID string, count int64) (server.Team, error) {
+	b.mutex.Lock()
+	_, known := b.totals[teamID]
+	b.mutex.Unlock()
+
+	if !known {
+		// the team must exist, and we need its score to add to
+		team, err := b.writes.FindByID(ctx, teamID)
+		if err != nil {
+			return team, err
+		}
+		b.mutex.Lock()
+		if _, ok := b.totals[teamID]; !ok {
+			b.totals[teamID] = team.Clicks
+		}
+		b.mutex.Unlock()
+	}
+
+	b.mutex.Lock()
+	b.pending[teamID] += count
+	b.pendingClicks += count
+	team := server.Team{
+		ID:     teamID,
+		Clicks: b.totals[teamID] + b.flushing[teamID] + b.pending[teamID],
+	}
+	full := b.maxClicks <= b.pendingClicks
+	b.mutex.Unlock()
+
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default:
+			// a flush is already coming
+		}
+	}
+
+	return team, nil
+}
+
+// EndSeason flushes all waiting clicks, so they count for the season that ends.
+func (b *Batched) EndSeason(ctx context.Context, season server.Season) error {
+	b.flush(ctx)
+
+	b.flushMutex.Lock()
+	defer b.flushMutex.Unlock()
+
+	err := b.Postgres.EndSeason(ctx, season)
+	if err != nil {
+		return err
+	}
+
+	// every score is reset, clicks waiting since the flush are kept
+	b.mutex.Lock()
+	b.totals = make(map[string]int64)
+	for teamID := range b.pending {
+		b.totals[teamID] = 0
+	}
+	b.mutex.Unlock()
+
+	return nil
+}
+
+// DeleteTeam flushes all waiting clicks, then deletes the team.
+func (b *Batched) DeleteTeam(ctx context.Context, teamID string) error {
+	_, err := b.moderate(func() (server.Team, error) {
+		return server.Team{}, b.Postgres.DeleteTeam(ctx, teamID)
+	}, teamID)
+	return err
+}
+
+// RenameTeam flushes all waiting clicks, then renames the team.
+func (b *Batched) RenameTeam(ctx context.Context, teamID, newID string) (server.Team, error) {
+	return b.moderate(func() (server.Team, error) {
+		return b.Postgres.RenameTeam(ctx, teamID, newID)
+	}, teamID, newID)
+}
+
+// ResetTeam flushes all waiting clicks, then resets the team.
+func (b *Batched) ResetTeam(ctx context.Context, teamID string) (server.Team, error) {
+	return b.moderate(func() (server.Team, error) {
+		return b.Postgres.ResetTeam(ctx, teamID)
+	}, teamID)
+}
+
+// AdjustClicks flushes all waiting clicks, then adjusts the team's clicks.
+func (b *Batched) AdjustClicks(ctx context.Context, teamID string, count int64) (server.Team, error) {
+	return b.moderate(func() (server.Team, error) {
+		return b.Postgres.AdjustClicks(ctx, teamID, count)
+	}, teamID)
+}
+
+// moderate changes teams between flushes, and forgets their scores
+// so they are read again when clicked
+func (b *Batched) moderate(change func() (server.Team, error), teamIDs ...string) (server.Team, error) {
+	b.flush(context.Background())
+
+	b.flushMutex.Lock()
+	defer b.flushMutex.Unlock()
+
+	team, err := change()
+
+	b.mutex.Lock()
+	for _, teamID := range teamIDs {
+		delete(b.totals, teamID)
+	}
+	b.mutex.Unlock()
+
+	return team, err
+}
+
+// flush writes all waiting clicks, failed batches are retried with the next one
+func (b *Batched) flush(ctx context.Context) error {
+	b.flushMutex.Lock()
+	defer b.flushMutex.Unlock()
+
+	b.mutex.Lock()
+	batch := b.pending
+	b.flushing = batch
+	b.pending = make(map[string]int64)
+	b.pendingClicks = 0
+	b.mutex.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	// instances flushing the same teams must lock their rows in the same order,
+	// or they can deadlock
+	teamIDs := make([]string, 0, len(batch))
+	for teamID := range batch {
+		teamIDs = append(teamIDs, teamID)
+	}
+	sort.Strings(teamIDs)
+	counts := make([]int64, len(teamIDs))
+	for i, teamID := range teamIDs {
+		counts[i] = batch[teamID]
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, server.StoreTimeout)
+	defer cancel()
+
+	teams, err := b.writes.recordClickBatch(ctx, teamIDs, counts)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.flushing = nil
+	if err != nil {
+		log.Printf("can't flush %d teams' clicks, retrying later: %v", len(batch), err)
+		for teamID, count := range batch {
+			b.pending[teamID] += count
+			b.pendingClicks += count
+		}
+		return err
+	}
+
+	for _, team := range teams {
+		b.totals[team.ID] = team.Clicks
+	}
+	return nil
+}
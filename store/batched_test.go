@@ -0,0 +1,225 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fabjan/mmocg/server"
+)
+
+// fakeWrites stands in for Postgres behind a Batched, failing as told
+type fakeWrites struct {
+	mutex sync.Mutex
+	teams map[string]int64
+	// batches are the counts of every successful write
+	batches []map[string]int64
+	// failures is how many writes fail before they start working
+	failures int
+	closed   bool
+}
+
+func newFakeWrites(teams map[string]int64) *fakeWrites {
+	return &fakeWrites{teams: teams}
+}
+
+func (f *fakeWrites) FindByID(ctx context.Context, teamID string) (server.Team, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	clicks, ok := f.teams[teamID]
+	if !ok {
+		return server.Team{}, server.ErrNotFound
+	}
+	return server.Team{ID: teamID, Clicks: clicks}, nil
+}
+
+func (f *fakeWrites) recordClickBatch(ctx context.Context, teamIDs []string, counts []int64) (server.Leaderboard, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if 0 < f.failures {
+		f.failures--
+		return nil, errors.New("database is down")
+	}
+
+	batch := map[string]int64{}
+	teams := server.Leaderboard{}
+	for i, teamID := range teamIDs {
+		batch[teamID] = counts[i]
+		f.teams[teamID] += counts[i]
+		teams = append(teams, server.Team{ID: teamID, Clicks: f.teams[teamID]})
+	}
+	f.batches = append(f.batches, batch)
+	return teams, nil
+}
+
+func (f *fakeWrites) Close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+}
+
+func (f *fakeWrites) written() ([]map[string]int64, map[string]int64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	teams := map[string]int64{}
+	for teamID, clicks := range f.teams {
+		teams[teamID] = clicks
+	}
+	return append([]map[string]int64(nil), f.batches...), teams
+}
+
+// newTestBatched never flushes by itself, unless maxClicks are waiting
+func newTestBatched(writes *fakeWrites, maxClicks int64) *Batched {
+	return newBatched(nil, writes, time.Hour, maxClicks)
+}
+
+func clickBatched(t *testing.T, b *Batched, teamID string, count, want int64) {
+	t.Helper()
+	team, err := b.RecordClicks(context.Background(), teamID, count)
+	if err != nil {
+		t.Fatalf("RecordClicks: %v", err)
+	}
+	if team.Clicks != want {
+		t.Errorf("clicked %s to %d, want %d", teamID, team.Clicks, want)
+	}
+}
+
+func TestBatchedAddsUp(t *testing.T) {
+	writes := newFakeWrites(map[string]int64{"a": 10, "b": 0})
+	b := newTestBatched(writes, 1000)
+	defer b.Close()
+
+	// teams are returned as they will be after the flush
+	clickBatched(t, b, "a", 2, 12)
+	clickBatched(t, b, "b", 1, 1)
+	clickBatched(t, b, "a", 3, 15)
+
+	if batches, _ := writes.written(); len(batches) != 0 {
+		t.Fatalf("wrote %v before flushing", batches)
+	}
+	if err := b.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	batches, teams := writes.written()
+	want := []map[string]int64{{"a": 5, "b": 1}}
+	if !reflect.DeepEqual(batches, want) {
+		t.Errorf("wrote %v, want %v", batches, want)
+	}
+	if teams["a"] != 15 || teams["b"] != 1 {
+		t.Errorf("teams are %v after flushing", teams)
+	}
+
+	// the next batch adds to the flushed scores
+	clickBatched(t, b, "a", 1, 16)
+
+	_, err := b.RecordClicks(context.Background(), "nope", 1)
+	if !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("clicking a missing team: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestBatchedFlushesWhenFull(t *testing.T) {
+	writes := newFakeWrites(map[string]int64{"a": 0})
+	b := newTestBatched(writes, 5)
+	defer b.Close()
+
+	clickBatched(t, b, "a", 2, 2)
+	clickBatched(t, b, "a", 3, 5)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, teams := writes.written(); teams["a"] == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("a full batch was not flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBatchedRetry(t *testing.T) {
+	writes := newFakeWrites(map[string]int64{"a": 10})
+	writes.failures = 1
+	b := newTestBatched(writes, 1000)
+	defer b.Close()
+
+	clickBatched(t, b, "a", 2, 12)
+	if err := b.Flush(context.Background()); err == nil {
+		t.Fatal("a failing flush succeeded")
+	}
+
+	// the failed batch is added to the next one
+	clickBatched(t, b, "a", 3, 15)
+	if err := b.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	batches, teams := writes.written()
+	if want := []map[string]int64{{"a": 5}}; !reflect.DeepEqual(batches, want) {
+		t.Errorf("wrote %v, want %v", batches, want)
+	}
+	if teams["a"] != 15 {
+		t.Errorf("a has %d clicks, want 15", teams["a"])
+	}
+}
+
+func TestBatchedClose(t *testing.T) {
+	defer func(interval time.Duration) { closeRetryInterval = interval }(closeRetryInterval)
+	closeRetryInterval = time.Millisecond
+
+	writes := newFakeWrites(map[string]int64{"a": 0})
+	writes.failures = 3
+	b := newTestBatched(writes, 1000)
+
+	clickBatched(t, b, "a", 2, 2)
+	b.Close()
+
+	_, teams := writes.written()
+	if teams["a"] != 2 {
+		t.Errorf("a has %d clicks after closing, want the last flush retried", teams["a"])
+	}
+	if !writes.closed {
+		t.Errorf("Postgres was not closed")
+	}
+}
+
+func TestBatchedCloseGivesUp(t *testing.T) {
+	defer func(timeout, interval time.Duration) {
+		closeFlushTimeout, closeRetryInterval = timeout, interval
+	}(closeFlushTimeout, closeRetryInterval)
+	closeFlushTimeout = 50 * time.Millisecond
+	closeRetryInterval = time.Millisecond
+
+	writes := newFakeWrites(map[string]int64{"a": 0})
+	writes.failures = 1 << 30
+	b := newTestBatched(writes, 1000)
+
+	clickBatched(t, b, "a", 2, 2)
+	b.Close()
+
+	if !writes.closed {
+		t.Errorf("Postgres was not closed")
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"sort"
+	"time"
+
+	"github.com/fabjan/mmocg/server"
+)
+
+// The resolutions clicks are bucketed in. Windows are summed
+// from the finest resolution that covers them.
+var bucketResolutions = []struct {
+	width time.Duration
+	count int
+}{
+	{time.Minute, 60},
+	{time.Hour, 7 * 24},
+}
+
+// MaxWindow is the longest window supported by windowed leaderboards.
+var MaxWindow = 7 * 24 * time.Hour
+
+// bucketRing counts clicks per team in fixed width time buckets,
+// reusing the oldest bucket so memory use is bounded.
+type bucketRing struct {
+	width   time.Duration
+	buckets []clickBucket
+}
+
+type clickBucket struct {
+	start  time.Time
+	clicks map[string]int64
+}
+
+func newBucketRing(width time.Duration, count int) *bucketRing {
+	return &bucketRing{
+		width:   width,
+		buckets: make([]clickBucket, count),
+	}
+}
+
+func (br *bucketRing) record(teamID string, count int64, at time.Time) {
+	start := at.Truncate(br.width)
+	i := int(start.UnixNano()/int64(br.width)) % len(br.buckets)
+	b := &br.buckets[i]
+	if !b.start.Equal(start) {
+		if start.Before(b.start) {
+			// too old to record
+			return
+		}
+		b.start = start
+		b.clicks = make(map[string]int64)
+	}
+	b.clicks[teamID] += count
+}
+
+// sum adds up clicks in all buckets overlapping the window ending now
+func (br *bucketRing) sum(window time.Duration, now time.Time) map[string]int64 {
+	from := now.Add(-window)
+	sums := make(map[string]int64)
+	for _, b := range br.buckets {
+		if b.clicks == nil || !from.Before(b.start.Add(br.width)) || now.Before(b.start) {
+			continue
+		}
+		for id, clicks := range b.clicks {
+			sums[id] += clicks
+		}
+	}
+	return sums
+}
+
+// rename moves the clicks of a team to another, adding them up if both have clicks.
+// Removing a team is renaming it to the empty ID.
+func (br *bucketRing) rename(from, to string) {
+	for _, b := range br.buckets {
+		clicks, ok := b.clicks[from]
+		if !ok {
+			continue
+		}
+		delete(b.clicks, from)
+		if to != "" {
+			b.clicks[to] += clicks
+		}
+	}
+}
+
+// windowCounter keeps bucket rings for each resolution.
+type windowCounter struct {
+	rings []*bucketRing
+}
+
+func newWindowCounter() *windowCounter {
+	wc := windowCounter{}
+	for _, res := range bucketResolutions {
+		wc.rings = append(wc.rings, newBucketRing(res.width, res.count))
+	}
+	return &wc
+}
+
+func (wc *windowCounter) record(teamID string, count int64, at time.Time) {
+	for _, r := range wc.rings {
+		r.record(teamID, count, at)
+	}
+}
+
+func (wc *windowCounter) rename(from, to string) {
+	for _, r := range wc.rings {
+		r.rename(from, to)
+	}
+}
+
+func (wc *windowCounter) remove(teamID string) {
+	wc.rename(teamID, "")
+}
+
+// leaderboard ranks teams by their clicks within the window
+func (wc *windowCounter) leaderboard(window time.Duration, now time.Time) server.Leaderboard {
+	ring := wc.rings[len(wc.rings)-1]
+	for _, r := range wc.rings {
+		if window <= r.width*time.Duration(len(r.buckets)) {
+			ring = r
+			break
+		}
+	}
+
+	leaderboard := server.Leaderboard{}
+	for id, clicks := range ring.sum(window, now) {
+		leaderboard = append(leaderboard, server.Team{ID: id, Clicks: clicks})
+	}
+	sort.Slice(leaderboard, func(i, j int) bool {
+		return rankedBefore(leaderboard[i], leaderboard[j])
+	})
+
+	return leaderboard
+}
+
+// bucketState is a bucket as saved in snapshots.
+type bucketState struct {
+	Width  time.Duration    `json:"width"`
+	Start  time.Time        `json:"start"`
+	Clicks map[string]int64 `json:"clicks"`
+}
+
+func (wc *windowCounter) state() []bucketState {
+	var state []bucketState
+	for _, r := range wc.rings {
+		for _, b := range r.buckets {
+			if b.clicks != nil {
+				state = append(state, bucketState{r.width, b.start, b.clicks})
+			}
+		}
+	}
+	return state
+}
+
+func (wc *windowCounter) restore(state []bucketState) {
+	for _, b := range state {
+		for _, r := range wc.rings {
+			if r.width != b.Width {
+				continue
+			}
+			for id, clicks := range b.Clicks {
+				r.record(id, clicks, b.Start)
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/fabjan/mmocg/metrics"
+	"github.com/fabjan/mmocg/server"
+)
+
+// Instrumented measures the latency of every operation of a store.
+type Instrumented struct {
+	store   server.Store
+	backend string
+}
+
+// NewInstrumented wraps the store, labelling its metrics with the backend name.
+func NewInstrumented(store server.Store, backend string) *Instrumented {
+	return &Instrumented{store, backend}
+}
+
+func (s *Instrumented) observe(operation string, start time.Time, err error) {
+	metrics.StoreOperation(s.backend, operation, start, err)
+}
+
+// CreateTeam creates a new team, an error means the ID is taken.
+func (s *Instrumented) CreateTeam(ctx context.Context, teamID string) (server.Team, error) {
+	start := time.Now()
+	team, err := s.store.CreateTeam(ctx, teamID)
+	s.observe("CreateTeam", start, err)
+	return team, err
+}
+
+// FindByID returns a single team if found by ID.
+func (s *Instrumented) FindByID(ctx context.Context, teamID string) (server.Team, error) {
+	start := time.Now()
+	team, err := s.store.FindByID(ctx, teamID)
+	s.observe("FindByID", start, err)
+	return team, err
+}
+
+// GetLeaderboard returns the highest scoring teams.
+func (s *Instrumented) GetLeaderboard(ctx context.Context) (server.Leaderboard, error) {
+	start := time.Now()
+	lb, err := s.store.GetLeaderboard(ctx)
+	s.observe("GetLeaderboard", start, err)
+	return lb, err
+}
+
+// GetLeaderboardPage returns at most limit teams after the cursor (if any), skipping the offset highest scoring.
+func (s *Instrumented) GetLeaderboardPage(ctx context.Context, after *server.Cursor, offset, limit int) (server.Leaderboard, error) {
+	start := time.Now()
+	lb, err := s.store.GetLeaderboardPage(ctx, after, offset, limit)
+	s.observe("GetLeaderboardPage", start, err)
+	return lb, err
+}
+
+// GetLeaderboardAround returns the given team and the n teams above and below it.
+func (s *Instrumented) GetLeaderboardAround(ctx context.Context, teamID string, n int) (server.Leaderboard, error) {
+	start := time.Now()
+	lb, err := s.store.GetLeaderboardAround(ctx, teamID, n)
+	s.observe("GetLeaderboardAround", start, err)
+	return lb, err
+}
+
+// GetWindowLeaderboard returns the teams scoring the most during the last window of time.
+func (s *Instrumented) GetWindowLeaderboard(ctx context.Context, window time.Duration, offset, limit int) (server.Leaderboard, error) {
+	start := time.Now()
+	lb, err := s.store.GetWindowLeaderboard(ctx, window, offset, limit)
+	s.observe("GetWindowLeaderboard", start, err)
+	return lb, err
+}
+
+// GetStanding returns the rank of the given team.
+func (s *Instrumented) GetStanding(ctx context.Context, teamID string) (server.Standing, error) {
+	start := time.Now()
+	standing, err := s.store.GetStanding(ctx, teamID)
+	s.observe("GetStanding", start, err)
+	return standing, err
+}
+
+// RecordClicks stores clicks for the given team.
+func (s *Instrumented) RecordClicks(ctx context.Context, teamID string, count int64) (server.Team, error) {
+	start := time.Now()
+	team, err := s.store.RecordClicks(ctx, teamID, count)
+	s.observe("RecordClicks", start, err)
+	return team, err
+}
+
+// EndSeason archives the current standings and resets all clicks.
+func (s *Instrumented) EndSeason(ctx context.Context, season server.Season) error {
+	start := time.Now()
+	err := s.store.EndSeason(ctx, season)
+	s.observe("EndSeason", start, err)
+	return err
+}
+
+// GetSeasons returns all ended seasons, oldest first.
+func (s *Instrumented) GetSeasons(ctx context.Context) ([]server.Season, error) {
+	start := time.Now()
+	seasons, err := s.store.GetSeasons(ctx)
+	s.observe("GetSeasons", start, err)
+	return seasons, err
+}
+
+// GetSeasonLeaderboard returns the final standings of an ended season.
+func (s *Instrumented) GetSeasonLeaderboard(ctx context.Context, seasonID string) (server.Leaderboard, error) {
+	start := time.Now()
+	lb, err := s.store.GetSeasonLeaderboard(ctx, seasonID)
+	s.observe("GetSeasonLeaderboard", start, err)
+	return lb, err
+}
+
+// DeleteTeam removes a team and its clicks.
+func (s *Instrumented) DeleteTeam(ctx context.Context, teamID string) error {
+	start := time.Now()
+	err := s.store.DeleteTeam(ctx, teamID)
+	s.observe("DeleteTeam", start, err)
+	return err
+}
+
+// RenameTeam gives a team a new ID, merging it with any team already using it.
+func (s *Instrumented) RenameTeam(ctx context.Context, teamID, newID string) (server.Team, error) {
+	start := time.Now()
+	team, err := s.store.RenameTeam(ctx, teamID, newID)
+	s.observe("RenameTeam", start, err)
+	return team, err
+}
+
+// ResetTeam takes away all clicks from a team.
+func (s *Instrumented) ResetTeam(ctx context.Context, teamID string) (server.Team, error) {
+	start := time.Now()
+	team, err := s.store.ResetTeam(ctx, teamID)
+	s.observe("ResetTeam", start, err)
+	return team, err
+}
+
+// AdjustClicks adds or takes away clicks from a team.
+func (s *Instrumented) AdjustClicks(ctx context.Context, teamID string, count int64) (server.Team, error) {
+	start := time.Now()
+	team, err := s.store.AdjustClicks(ctx, teamID, count)
+	s.observe("AdjustClicks", start, err)
+	return team, err
+}
+
+// GetRecentTeams returns the most recently created teams, newest first.
+func (s *Instrumented) GetRecentTeams(ctx context.Context, limit int) ([]server.CreatedTeam, error) {
+	start := time.Now()
+	teams, err := s.store.GetRecentTeams(ctx, limit)
+	s.observe("GetRecentTeams", start, err)
+	return teams, err
+}
+
+// GetBans returns all bans, oldest first.
+func (s *Instrumented) GetBans(ctx context.Context) ([]server.Ban, error) {
+	start := time.Now()
+	bans, err := s.store.GetBans(ctx)
+	s.observe("GetBans", start, err)
+	return bans, err
+}
+
+// AddBan adds a ban, replacing any ban with the same rule.
+func (s *Instrumented) AddBan(ctx context.Context, ban server.Ban) error {
+	start := time.Now()
+	err := s.store.AddBan(ctx, ban)
+	s.observe("AddBan", start, err)
+	return err
+}
+
+// RemoveBan removes the ban with the given rule.
+func (s *Instrumented) RemoveBan(ctx context.Context, rule server.BanRule) error {
+	start := time.Now()
+	err := s.store.RemoveBan(ctx, rule)
+	s.observe("RemoveBan", start, err)
+	return err
+}
+
+// RecordAudit appends entries to the audit trail.
+func (s *Instrumented) RecordAudit(ctx context.Context, entries []server.AuditEntry) error {
+	start := time.Now()
+	err := s.store.RecordAudit(ctx, entries)
+	s.observe("RecordAudit", start, err)
+	return err
+}
+
+// GetAudit returns the matching audit entries, newest first.
+func (s *Instrumented) GetAudit(ctx context.Context, filter server.AuditFilter) ([]server.AuditEntry, error) {
+	start := time.Now()
+	entries, err := s.store.GetAudit(ctx, filter)
+	s.observe("GetAudit", start, err)
+	return entries, err
+}
+
+// Flush flushes the wrapped store.
+func (s *Instrumented) Flush(ctx context.Context) error {
+	start := time.Now()
+	err := s.store.Flush(ctx)
+	s.observe("Flush", start, err)
+	return err
+}
+
+// Ping checks the wrapped store.
+func (s *Instrumented) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := s.store.Ping(ctx)
+	s.observe("Ping", start, err)
+	return err
+}
+
+// Close closes the wrapped store.
+func (s *Instrumented) Close() {
+	s.store.Close()
+}
@@ -0,0 +1,419 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fabjan/mmocg/server"
+)
+
+// SyncPolicy decides how often the journal is flushed to disk.
+type SyncPolicy string
+
+// The available sync policies, trading durability for speed.
+const (
+	// SyncEveryOp syncs after every operation, nothing acknowledged is lost.
+	SyncEveryOp SyncPolicy = "op"
+	// SyncBatched syncs after every JournalOptions.BatchSize operations.
+	SyncBatched SyncPolicy = "batch"
+	// SyncInterval syncs every JournalOptions.Interval.
+	SyncInterval SyncPolicy = "interval"
+)
+
+// ParseSyncPolicy returns the policy with the given name.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch p := SyncPolicy(name); p {
+	case SyncEveryOp, SyncBatched, SyncInterval:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown sync policy %q", name)
+}
+
+// JournalOptions configures the journal of a durable MutMap.
+type JournalOptions struct {
+	// Dir is where the journal and snapshots are kept
+	Dir  string
+	Sync SyncPolicy
+	// BatchSize is used by SyncBatched
+	BatchSize int
+	// Interval is used by SyncInterval
+	Interval time.Duration
+	// SnapshotInterval is how often the journal is compacted into a snapshot
+	SnapshotInterval time.Duration
+}
+
+const (
+	snapshotFile   = "snapshot.json"
+	segmentPrefix  = "journal-"
+	segmentSuffix  = ".log"
+	segmentPattern = segmentPrefix + "%020d" + segmentSuffix
+	// maxEntrySize is the longest line (with its newline) replay can read
+	maxEntrySize = 1024 * 1024
+)
+
+// journalEntry is one MutMap operation.
+type journalEntry struct {
+	Seq    uint64         `json:"seq"`
+	Op     string         `json:"op"`
+	TeamID string         `json:"team,omitempty"`
+	NewID  string         `json:"newId,omitempty"`
+	Count  int64          `json:"count,omitempty"`
+	At     time.Time      `json:"at"`
+	Season *server.Season `json:"season,omitempty"`
+	Ban    *server.Ban    `json:"ban,omitempty"`
+	// Audit is only used by opAudit
+	Audit []server.AuditEntry `json:"audit,omitempty"`
+}
+
+// The journaled operations.
+const (
+	opCreate    = "create"
+	opClicks    = "clicks"
+	opEndSeason = "endSeason"
+	opDelete    = "delete"
+	opRename    = "rename"
+	opReset     = "reset"
+	opAdjust    = "adjust"
+	opBan       = "ban"
+	opUnban     = "unban"
+	opAudit     = "audit"
+)
+
+// snapshotHeader precedes the state in a snapshot.
+type snapshotHeader struct {
+	// Seq is the last journal entry included in the snapshot
+	Seq   uint64          `json:"seq"`
+	State json.RawMessage `json:"state"`
+}
+
+// journal is an append-only log of operations split in segments, where all
+// segments before the current one can be replaced by a snapshot.
+type journal struct {
+	opts JournalOptions
+
+	mutex sync.Mutex
+	file  segmentFile
+	// size is where the next entry starts in the current segment
+	size     int64
+	seq      uint64
+	unsynced int
+	// broken is set when a failed write could not be undone,
+	// nothing more can be appended after it
+	broken error
+}
+
+// segmentFile is the open segment, an *os.File except in tests.
+type segmentFile interface {
+	Write(b []byte) (int, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+func openJournal(opts JournalOptions) (*journal, error) {
+	if opts.Sync == SyncBatched && opts.BatchSize < 1 {
+		return nil, errors.New("batched sync needs a batch size")
+	}
+	if opts.Sync == SyncInterval && opts.Interval <= 0 {
+		return nil, errors.New("interval sync needs an interval")
+	}
+
+	err := os.MkdirAll(opts.Dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{opts: opts}, nil
+}
+
+// load restores the latest snapshot and replays all later entries,
+// then opens a new segment for appending.
+func (j *journal) load(restore func(state []byte) error, replay func(e journalEntry) error) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(j.opts.Dir, snapshotFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var snap snapshotHeader
+		err = json.Unmarshal(data, &snap)
+		if err != nil {
+			return fmt.Errorf("bad snapshot: %w", err)
+		}
+		err = restore(snap.State)
+		if err != nil {
+			return fmt.Errorf("bad snapshot: %w", err)
+		}
+		j.seq = snap.Seq
+	}
+
+	segments, err := j.segments()
+	if err != nil {
+		return err
+	}
+	for _, name := range segments {
+		err = j.replaySegment(name, replay)
+		if err != nil {
+			return err
+		}
+	}
+
+	return j.lockedStartSegment()
+}
+
+func (j *journal) replaySegment(name string, replay func(e journalEntry) error) error {
+	f, err := os.Open(filepath.Join(j.opts.Dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// a torn write can only be the last line of a segment, nothing is
+	// appended after one until the next segment is started
+	var torn error
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxEntrySize)
+	for scanner.Scan() {
+		if torn != nil {
+			return fmt.Errorf("journal %s has a bad entry after %d: %w", name, j.seq, torn)
+		}
+		var e journalEntry
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			torn = err
+			continue
+		}
+		if e.Seq <= j.seq {
+			// already in the snapshot
+			continue
+		}
+		if e.Seq != j.seq+1 {
+			return fmt.Errorf("journal %s skips from entry %d to %d", name, j.seq, e.Seq)
+		}
+		err = replay(e)
+		if err != nil {
+			return fmt.Errorf("can't replay entry %d: %w", e.Seq, err)
+		}
+		j.seq = e.Seq
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+
+	if torn != nil {
+		// nothing in it was acknowledged
+		log.Printf("journal %s ends with a torn write, ignoring it: %v", name, torn)
+	}
+	return nil
+}
+
+// segments lists the segment files in order
+func (j *journal) segments() ([]string, error) {
+	entries, err := os.ReadDir(j.opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, segmentPrefix) && strings.HasSuffix(name, segmentSuffix) {
+			names = append(names, name)
+		}
+	}
+	// zero padded sequence numbers sort as strings
+	sort.Strings(names)
+	return names, nil
+}
+
+func (j *journal) lockedStartSegment() error {
+	name := filepath.Join(j.opts.Dir, fmt.Sprintf(segmentPattern, j.seq+1))
+	// a segment starting after the last entry can only hold torn writes
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	j.file = f
+	j.size = 0
+	j.unsynced = 0
+	// torn bytes left at the end of the last segment are skipped on replay
+	j.broken = nil
+	return nil
+}
+
+// append writes the entry, syncing according to the policy
+func (j *journal) append(e journalEntry) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.broken != nil {
+		return j.broken
+	}
+
+	e.Seq = j.seq + 1
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if maxEntrySize < len(line) {
+		// it could be written, but not replayed
+		return fmt.Errorf("journal entry is %d bytes, at most %d fit", len(line), maxEntrySize)
+	}
+
+	_, err = j.file.Write(line)
+	if err != nil {
+		// a partial write must not be left for the next entry to be appended to
+		terr := j.file.Truncate(j.size)
+		if terr != nil {
+			j.broken = fmt.Errorf("journal is broken, can't undo a failed write: %w", terr)
+			log.Print(j.broken)
+		}
+		return fmt.Errorf("can't write journal: %w", err)
+	}
+	j.size += int64(len(line))
+	j.seq = e.Seq
+	j.unsynced++
+
+	switch j.opts.Sync {
+	case SyncEveryOp:
+		return j.lockedSync()
+	case SyncBatched:
+		if j.opts.BatchSize <= j.unsynced {
+			return j.lockedSync()
+		}
+	}
+
+	return nil
+}
+
+func (j *journal) sync() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.lockedSync()
+}
+
+func (j *journal) lockedSync() error {
+	if j.unsynced == 0 {
+		return nil
+	}
+	err := j.file.Sync()
+	if err != nil {
+		return fmt.Errorf("can't sync journal: %w", err)
+	}
+	j.unsynced = 0
+	return nil
+}
+
+// rotate closes the current segment and starts a new one,
+// returning the last sequence number in the closed segment
+func (j *journal) rotate() (uint64, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	err := j.lockedSync()
+	if err != nil {
+		return 0, err
+	}
+	err = j.file.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	return j.seq, j.lockedStartSegment()
+}
+
+// writeSnapshot atomically replaces the snapshot, then deletes
+// all segments covered by it
+func (j *journal) writeSnapshot(seq uint64, state []byte) error {
+	data, err := json.Marshal(snapshotHeader{Seq: seq, State: state})
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(j.opts.Dir, snapshotFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("can't write snapshot: %w", err)
+	}
+
+	err = os.Rename(tmp, filepath.Join(j.opts.Dir, snapshotFile))
+	if err != nil {
+		return fmt.Errorf("can't replace snapshot: %w", err)
+	}
+	syncDir(j.opts.Dir)
+
+	segments, err := j.segments()
+	if err != nil {
+		return err
+	}
+	current := fmt.Sprintf(segmentPattern, seq+1)
+	for _, name := range segments {
+		if current <= name {
+			break
+		}
+		err = os.Remove(filepath.Join(j.opts.Dir, name))
+		if err != nil {
+			return fmt.Errorf("can't remove compacted journal: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (j *journal) close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	err := j.lockedSync()
+	if cerr := j.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncDir makes a rename durable, errors are ignored since
+// not all platforms can sync directories
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,259 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// tornFile writes half of the next entry, then fails like a full disk
+type tornFile struct {
+	segmentFile
+	failTruncate bool
+	torn         bool
+}
+
+func (f *tornFile) Write(b []byte) (int, error) {
+	if f.torn {
+		return f.segmentFile.Write(b)
+	}
+	f.torn = true
+	n, err := f.segmentFile.Write(b[:len(b)/2])
+	if err != nil {
+		return n, err
+	}
+	return n, syscall.ENOSPC
+}
+
+func (f *tornFile) Truncate(size int64) error {
+	if f.failTruncate {
+		return syscall.EIO
+	}
+	return f.segmentFile.Truncate(size)
+}
+
+func openTestJournal(t *testing.T, dir string) (*journal, []journalEntry) {
+	j, err := openJournal(JournalOptions{Dir: dir, Sync: SyncEveryOp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replayed []journalEntry
+	err = j.load(
+		func(state []byte) error { return nil },
+		func(e journalEntry) error {
+			replayed = append(replayed, e)
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j, replayed
+}
+
+func replayedTeams(entries []journalEntry) []string {
+	var teams []string
+	for _, e := range entries {
+		teams = append(teams, e.TeamID)
+	}
+	return teams
+}
+
+func TestJournalTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	j, _ := openTestJournal(t, dir)
+
+	if err := j.append(journalEntry{Op: opCreate, TeamID: "🐱"}); err != nil {
+		t.Fatal(err)
+	}
+	j.file = &tornFile{segmentFile: j.file}
+	if err := j.append(journalEntry{Op: opCreate, TeamID: "🐶"}); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("torn write: got %v, want ENOSPC", err)
+	}
+	// acknowledged after the torn write, so it must survive a restart
+	if err := j.append(journalEntry{Op: opCreate, TeamID: "🐭"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	j, replayed := openTestJournal(t, dir)
+	defer j.close()
+
+	teams := replayedTeams(replayed)
+	if len(teams) != 2 || teams[0] != "🐱" || teams[1] != "🐭" {
+		t.Fatalf("replayed %v, want [🐱 🐭]", teams)
+	}
+	for i, e := range replayed {
+		if e.Seq != uint64(i+1) {
+			t.Errorf("entry %d has seq %d, want %d", i, e.Seq, i+1)
+		}
+	}
+}
+
+func TestJournalEntryTooLong(t *testing.T) {
+	dir := t.TempDir()
+	j, _ := openTestJournal(t, dir)
+
+	long := journalEntry{Op: opCreate, TeamID: strings.Repeat("🐱", maxEntrySize/4)}
+	if err := j.append(long); err == nil {
+		t.Fatal("appended an entry too long to replay")
+	}
+	if err := j.append(journalEntry{Op: opCreate, TeamID: "🐭"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	j, replayed := openTestJournal(t, dir)
+	defer j.close()
+
+	teams := replayedTeams(replayed)
+	if len(teams) != 1 || teams[0] != "🐭" || replayed[0].Seq != 1 {
+		t.Fatalf("replayed %v, want [🐭] as the first entry", teams)
+	}
+}
+
+func TestJournalBrokenUntilRotated(t *testing.T) {
+	dir := t.TempDir()
+	j, _ := openTestJournal(t, dir)
+
+	j.file = &tornFile{segmentFile: j.file, failTruncate: true}
+	if err := j.append(journalEntry{Op: opCreate, TeamID: "🐶"}); err == nil {
+		t.Fatal("torn write succeeded")
+	}
+	// the torn bytes can't be removed, appending after them would lose the entry
+	if err := j.append(journalEntry{Op: opCreate, TeamID: "🐭"}); err == nil {
+		t.Fatal("append to a broken journal succeeded")
+	}
+
+	if _, err := j.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.append(journalEntry{Op: opCreate, TeamID: "🐹"}); err != nil {
+		t.Fatalf("append after rotating: %v", err)
+	}
+	if err := j.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	j, replayed := openTestJournal(t, dir)
+	defer j.close()
+
+	teams := replayedTeams(replayed)
+	if len(teams) != 1 || teams[0] != "🐹" {
+		t.Fatalf("replayed %v, want [🐹]", teams)
+	}
+}
+
+// entryLine is a journaled create on the form append writes it
+func entryLine(t *testing.T, seq uint64) string {
+	line, err := json.Marshal(journalEntry{Seq: seq, Op: opCreate, TeamID: fmt.Sprint(seq)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(line) + "\n"
+}
+
+func TestJournalReplay(t *testing.T) {
+	torn := `{"seq":3,"op":"cre`
+
+	tests := []struct {
+		name string
+		// segments are the lines in the segment starting at each entry
+		segments map[uint64][]string
+		// replayed are the sequence numbers replayed, if it can be loaded
+		replayed []uint64
+		ok       bool
+	}{
+		{
+			name:     "torn last segment",
+			segments: map[uint64][]string{1: {entryLine(t, 1), entryLine(t, 2), torn}},
+			replayed: []uint64{1, 2},
+			ok:       true,
+		},
+		{
+			name: "torn segment before a restart",
+			segments: map[uint64][]string{
+				1: {entryLine(t, 1), entryLine(t, 2), torn + "\n"},
+				3: {entryLine(t, 3)},
+			},
+			replayed: []uint64{1, 2, 3},
+			ok:       true,
+		},
+		{
+			name:     "bad entry before others",
+			segments: map[uint64][]string{1: {entryLine(t, 1), torn + "\n", entryLine(t, 2)}},
+		},
+		{
+			name:     "skipped entry",
+			segments: map[uint64][]string{1: {entryLine(t, 1), entryLine(t, 3)}},
+		},
+		{
+			name: "missing segment",
+			segments: map[uint64][]string{
+				1: {entryLine(t, 1), entryLine(t, 2)},
+				4: {entryLine(t, 4)},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		for first, lines := range tt.segments {
+			name := filepath.Join(dir, fmt.Sprintf(segmentPattern, first))
+			if err := os.WriteFile(name, []byte(strings.Join(lines, "")), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		j, err := openJournal(JournalOptions{Dir: dir, Sync: SyncEveryOp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var replayed []uint64
+		err = j.load(
+			func(state []byte) error { return nil },
+			func(e journalEntry) error {
+				replayed = append(replayed, e.Seq)
+				return nil
+			},
+		)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: loaded, want an error", tt.name)
+				j.close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		j.close()
+		if fmt.Sprint(replayed) != fmt.Sprint(tt.replayed) {
+			t.Errorf("%s: replayed %v, want %v", tt.name, replayed, tt.replayed)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrations are named like 0001_what_it_does.sql, and applied in order.
+// Each one is run in its own transaction, with {table} replaced by the
+// table name of the store.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+func loadMigrations() ([]migration, error) {
+	names, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	for _, entry := range names {
+		name := entry.Name()
+		prefix := strings.SplitN(name, "_", 2)[0]
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has no version", name)
+		}
+		data, err := migrationFiles.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version, name, string(data)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration %s is out of sequence", m.name)
+		}
+	}
+
+	return migrations, nil
+}
+
+func createSchemaVersionSQL(name string) string {
+	sql := `
+CREATE TABLE IF NOT EXISTS %s_schema_version (
+	version INTEGER PRIMARY KEY,
+	appliedAt TIMESTAMPTZ NOT NULL DEFAULT now()
+)
+`
+	return fmt.Sprintf(sql, name)
+}
+
+func selectSchemaVersionSQL(name string) string {
+	return fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s_schema_version", name)
+}
+
+func insertSchemaVersionSQL(name string) string {
+	return fmt.Sprintf("INSERT INTO %s_schema_version (version) VALUES ($1)", name)
+}
+
+// MigratePostgres brings the schema of the store with the given table name
+// up to date, returning the versions before and after. It refuses to touch
+// a schema newer than this binary knows about.
+//
+// Several instances can migrate at the same time, they take turns.
+func MigratePostgres(ctx context.Context, db *sql.DB, name string) (int, int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, 0, err
+	}
+	latest := len(migrations)
+
+	_, err = db.ExecContext(ctx, createSchemaVersionSQL(name))
+	if err != nil {
+		return 0, 0, fmt.Errorf("can't create schema version table: %w", err)
+	}
+
+	from := -1
+	for {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return from, from, err
+		}
+
+		version, err := lockedSchemaVersion(ctx, tx, name)
+		if err != nil {
+			tx.Rollback()
+			return from, version, err
+		}
+		if from < 0 {
+			from = version
+		}
+		if latest < version {
+			tx.Rollback()
+			return from, version, fmt.Errorf("database schema version %d is newer than this binary's %d", version, latest)
+		}
+		if version == latest {
+			tx.Rollback()
+			return from, version, nil
+		}
+
+		m := migrations[version]
+		_, err = tx.ExecContext(ctx, strings.ReplaceAll(m.sql, "{table}", name))
+		if err != nil {
+			tx.Rollback()
+			return from, version, fmt.Errorf("migration %s failed: %w", m.name, err)
+		}
+		_, err = tx.ExecContext(ctx, insertSchemaVersionSQL(name), m.version)
+		if err != nil {
+			tx.Rollback()
+			return from, version, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return from, version, fmt.Errorf("migration %s failed: %w", m.name, err)
+		}
+		log.Printf("applied migration %s", m.name)
+	}
+}
+
+// lockedSchemaVersion waits for other migrations to finish, then returns
+// the current version. The lock is held until the transaction ends.
+func lockedSchemaVersion(ctx context.Context, tx *sql.Tx, name string) (int, error) {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf("LOCK TABLE %s_schema_version IN EXCLUSIVE MODE", name))
+	if err != nil {
+		return 0, fmt.Errorf("can't lock schema version: %w", err)
+	}
+
+	var version int
+	err = tx.QueryRowContext(ctx, selectSchemaVersionSQL(name)).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("can't read schema version: %w", err)
+	}
+
+	return version, nil
+}
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS {table} (
+	teamID TEXT NOT NULL,
+	clicks NUMERIC,
+	UNIQUE(teamID)
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS {table}_seasons (
+	seasonID TEXT PRIMARY KEY,
+	startsAt TIMESTAMPTZ NOT NULL,
+	endsAt TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS {table}_history (
+	seasonID TEXT NOT NULL REFERENCES {table}_seasons (seasonID),
+	teamID TEXT NOT NULL,
+	clicks NUMERIC,
+	PRIMARY KEY (seasonID, teamID)
+);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS {table}_buckets (
+	resolution TEXT NOT NULL,
+	bucket TIMESTAMPTZ NOT NULL,
+	teamID TEXT NOT NULL,
+	clicks BIGINT NOT NULL,
+	PRIMARY KEY (resolution, bucket, teamID)
+);
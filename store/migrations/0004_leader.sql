@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS {table}_leader (
+	id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+	teamID TEXT NOT NULL,
+	previous TEXT NOT NULL,
+	clicks NUMERIC NOT NULL
+);
+INSERT INTO {table}_leader (teamID, previous, clicks)
+SELECT COALESCE(MIN(teamID), ''), COALESCE(MIN(teamID), ''), COALESCE(MIN(clicks), 0)
+FROM (SELECT teamID, clicks FROM {table} ORDER BY clicks DESC, teamID LIMIT 1) AS current
+ON CONFLICT (id) DO NOTHING;
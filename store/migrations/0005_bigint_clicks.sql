@@ -0,0 +1,14 @@
+-- Clicks are whole numbers, and BIGINT is both smaller and faster than NUMERIC.
+UPDATE {table} SET clicks = 0 WHERE clicks IS NULL;
+ALTER TABLE {table}
+	ALTER COLUMN clicks TYPE BIGINT,
+	ALTER COLUMN clicks SET DEFAULT 0,
+	ALTER COLUMN clicks SET NOT NULL;
+UPDATE {table}_history SET clicks = 0 WHERE clicks IS NULL;
+ALTER TABLE {table}_history
+	ALTER COLUMN clicks TYPE BIGINT,
+	ALTER COLUMN clicks SET NOT NULL;
+ALTER TABLE {table}_leader ALTER COLUMN clicks TYPE BIGINT;
+
+-- The leaderboard, standings and leader are all read in ranking order.
+CREATE INDEX IF NOT EXISTS {table}_ranking ON {table} (clicks DESC, teamID);
@@ -0,0 +1,6 @@
+-- Teams created before this are treated as created long ago.
+ALTER TABLE {table} ADD COLUMN createdAt TIMESTAMPTZ NOT NULL DEFAULT 'epoch';
+ALTER TABLE {table} ALTER COLUMN createdAt SET DEFAULT now();
+
+-- Moderators list the most recently created teams.
+CREATE INDEX IF NOT EXISTS {table}_created ON {table} (createdAt DESC, teamID);
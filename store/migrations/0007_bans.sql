@@ -0,0 +1,8 @@
+-- Bans keep teams from being created, clicked or listed.
+CREATE TABLE IF NOT EXISTS {table}_bans (
+	kind TEXT NOT NULL,
+	value TEXT NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	createdAt TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (kind, value)
+);
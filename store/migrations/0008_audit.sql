@@ -0,0 +1,13 @@
+-- The audit trail is append-only, it is read newest first.
+CREATE TABLE IF NOT EXISTS {table}_audit (
+	id BIGSERIAL PRIMARY KEY,
+	at TIMESTAMPTZ NOT NULL,
+	action TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	teamID TEXT NOT NULL DEFAULT '',
+	count BIGINT NOT NULL DEFAULT 0,
+	detail TEXT NOT NULL DEFAULT '',
+	sourceIP TEXT NOT NULL DEFAULT '',
+	requestID TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS {table}_audit_team ON {table}_audit (teamID, id DESC);
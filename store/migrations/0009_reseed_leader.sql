@@ -0,0 +1,7 @@
+-- Teams without clicks don't lead, but the leader was first seeded with the
+-- top team even if it had none. Only that seed leaves a team leading with zero clicks.
+UPDATE {table}_leader SET
+	teamID = COALESCE((SELECT teamID FROM {table} WHERE clicks > 0 ORDER BY clicks DESC, teamID LIMIT 1), ''),
+	previous = COALESCE((SELECT teamID FROM {table} WHERE clicks > 0 ORDER BY clicks DESC, teamID LIMIT 1), ''),
+	clicks = COALESCE((SELECT MAX(clicks) FROM {table}), 0)
+WHERE clicks = 0 AND teamID <> '';
@@ -16,52 +16,275 @@
 package store
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"sort"
 	"sync"
+	"time"
 
+	"github.com/fabjan/mmocg/events"
 	"github.com/fabjan/mmocg/server"
 )
 
 // MutMap is an in memory team score store.
+//
+// It can optionally be made durable by a journal of all operations,
+// which is compacted into snapshots and replayed on startup.
 type MutMap struct {
-	onNewTeam   chan string
-	onNewLeader chan string
+	events *events.Bus
 
 	mutex sync.RWMutex
 	teams map[string]server.Team
+	// created tells when each team was created
+	created map[string]time.Time
+	// ranking holds all team IDs ordered by clicks (descending),
+	// ties are ordered by ID. It is kept sorted on every update.
+	ranking *ranking
+	// leader is the ID of the team in the lead, it is not
+	// necessarily first in the ranking since ties don't take the lead
+	leader string
+
+	seasons       []server.Season
+	seasonHistory map[string]server.Leaderboard
+
+	windows *windowCounter
+
+	// bans are kept in the order they were added
+	bans []server.Ban
+	// audit is the newest part of the audit trail, oldest first
+	audit []server.AuditEntry
+
+	// journal is nil if the MutMap is not durable
+	journal       *journal
+	snapshotMutex sync.Mutex
+	done          chan struct{}
+	background    sync.WaitGroup
+}
+
+// MaxAuditEntries is how much of the audit trail a MutMap keeps,
+// older entries are forgotten.
+var MaxAuditEntries = 10000
+
+// mutMapState is what goes into snapshots.
+type mutMapState struct {
+	Teams   []server.Team                 `json:"teams"`
+	Seasons []server.Season               `json:"seasons"`
+	History map[string]server.Leaderboard `json:"history"`
+	Windows []bucketState                 `json:"windows"`
+	Leader  string                        `json:"leader,omitempty"`
+	Created map[string]time.Time          `json:"created,omitempty"`
+	Bans    []server.Ban                  `json:"bans,omitempty"`
+	Audit   []server.AuditEntry           `json:"audit,omitempty"`
 }
 
-// NewMutMap creates a new empty MutMap.
-func NewMutMap(onNewTeam, onNewLeader chan string) *MutMap {
+// NewMutMap creates a new MutMap. If journal options are given the
+// state is restored from the journal directory, otherwise it is empty.
+func NewMutMap(bus *events.Bus, opts *JournalOptions) (*MutMap, error) {
 	mm := MutMap{
-		onNewTeam:   onNewTeam,
-		onNewLeader: onNewLeader,
+		events: bus,
+		done:   make(chan struct{}),
 	}
 	mm.teams = make(map[string]server.Team)
-	return &mm
+	mm.created = make(map[string]time.Time)
+	mm.ranking = newRanking()
+	mm.seasonHistory = make(map[string]server.Leaderboard)
+	mm.windows = newWindowCounter()
+
+	if opts == nil {
+		return &mm, nil
+	}
+
+	j, err := openJournal(*opts)
+	if err != nil {
+		return nil, fmt.Errorf("can't open journal: %w", err)
+	}
+	err = j.load(mm.restore, mm.replay)
+	if err != nil {
+		return nil, fmt.Errorf("can't load journal: %w", err)
+	}
+	mm.journal = j
+
+	if opts.Sync == SyncInterval {
+		mm.every(opts.Interval, j.sync)
+	}
+	if 0 < opts.SnapshotInterval {
+		mm.every(opts.SnapshotInterval, mm.snapshot)
+	}
+
+	return &mm, nil
 }
 
-// Close closes the store (but MutMap has no connection)
+// Close closes the store, taking a final snapshot if it is durable
 func (mm *MutMap) Close() {
-	// noop
+	if mm.journal == nil {
+		return
+	}
+
+	close(mm.done)
+	mm.background.Wait()
+
+	err := mm.snapshot()
+	if err != nil {
+		log.Printf("final snapshot failed: %v", err)
+	}
+	err = mm.journal.close()
+	if err != nil {
+		log.Printf("closing journal failed: %v", err)
+	}
+}
+
+// every runs f in the background every interval until the MutMap is closed
+func (mm *MutMap) every(interval time.Duration, f func() error) {
+	mm.background.Add(1)
+	go func() {
+		defer mm.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-mm.done:
+				return
+			case <-ticker.C:
+				err := f()
+				if err != nil {
+					log.Printf("journal maintenance failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// snapshot compacts the journal into a new snapshot
+func (mm *MutMap) snapshot() error {
+	mm.snapshotMutex.Lock()
+	defer mm.snapshotMutex.Unlock()
+
+	mm.mutex.Lock()
+	state, err := json.Marshal(mm.lockedState())
+	if err != nil {
+		mm.mutex.Unlock()
+		return err
+	}
+	seq, err := mm.journal.rotate()
+	mm.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// writing files is slow, but doesn't need the lock
+	return mm.journal.writeSnapshot(seq, state)
+}
+
+func (mm *MutMap) lockedState() mutMapState {
+	state := mutMapState{
+		Seasons: mm.seasons,
+		History: mm.seasonHistory,
+		Windows: mm.windows.state(),
+		Leader:  mm.leader,
+		Created: mm.created,
+		Bans:    mm.bans,
+		Audit:   mm.audit,
+	}
+	for _, id := range mm.ranking.ids() {
+		state.Teams = append(state.Teams, mm.teams[id])
+	}
+	return state
+}
+
+// restore loads a snapshot, must only be used on a new MutMap
+func (mm *MutMap) restore(data []byte) error {
+	var state mutMapState
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+
+	for _, team := range state.Teams {
+		mm.teams[team.ID] = team
+		mm.ranking.set(team.ID, team.Clicks)
+	}
+	mm.seasons = state.Seasons
+	if state.History != nil {
+		mm.seasonHistory = state.History
+	}
+	mm.windows.restore(state.Windows)
+	mm.leader = state.Leader
+	for id, at := range state.Created {
+		mm.created[id] = at
+	}
+	mm.bans = state.Bans
+	mm.lockedAppendAudit(state.Audit)
+
+	return nil
+}
+
+// replay applies a journal entry, must only be used on a new MutMap
+func (mm *MutMap) replay(e journalEntry) error {
+	switch e.Op {
+	case opCreate:
+		if _, ok := mm.teams[e.TeamID]; ok {
+			return errors.New("team exists")
+		}
+		mm.lockedCreateTeam(e.TeamID, e.At)
+	case opClicks:
+		if _, ok := mm.teams[e.TeamID]; !ok {
+			return errors.New("team not found")
+		}
+		mm.lockedAddClicks(e.TeamID, e.Count, e.At)
+	case opEndSeason:
+		if e.Season == nil {
+			return errors.New("no season")
+		}
+		mm.lockedEndSeason(*e.Season)
+	case opDelete, opRename, opReset, opAdjust:
+		if _, ok := mm.teams[e.TeamID]; !ok {
+			return errors.New("team not found")
+		}
+		mm.lockedModerate(e)
+	case opBan:
+		if e.Ban == nil {
+			return errors.New("no ban")
+		}
+		mm.lockedAddBan(*e.Ban)
+	case opUnban:
+		if e.Ban == nil || !mm.lockedRemoveBan(e.Ban.BanRule) {
+			return errors.New("ban not found")
+		}
+	case opAudit:
+		mm.lockedAppendAudit(e.Audit)
+	default:
+		return fmt.Errorf("unknown operation %q", e.Op)
+	}
+	return nil
+}
+
+// lockedJournal writes an entry to the journal (if any),
+// it must be done before applying the operation
+func (mm *MutMap) lockedJournal(e journalEntry) error {
+	if mm.journal == nil {
+		return nil
+	}
+	return mm.journal.append(e)
 }
 
 // FindByID returns a single team if found by ID.
-func (mm *MutMap) FindByID(teamID string) (server.Team, error) {
+func (mm *MutMap) FindByID(ctx context.Context, teamID string) (server.Team, error) {
 	mm.mutex.RLock()
 	defer mm.mutex.RUnlock()
 
 	team, ok := mm.teams[teamID]
 	if !ok {
-		return team, errors.New("not found")
+		return team, server.ErrNotFound
 	}
 
 	return team, nil
 }
 
 // CreateTeam creates a new team, an error means the ID is taken.
-func (mm *MutMap) CreateTeam(teamID string) (server.Team, error) {
+func (mm *MutMap) CreateTeam(ctx context.Context, teamID string) (server.Team, error) {
 	mm.mutex.Lock()
 	defer mm.mutex.Unlock()
 
@@ -70,77 +293,508 @@ func (mm *MutMap) CreateTeam(teamID string) (server.Team, error) {
 		return team, errors.New("exists")
 	}
 
+	now := time.Now()
+	err := mm.lockedJournal(journalEntry{Op: opCreate, TeamID: teamID, At: now})
+	if err != nil {
+		return team, err
+	}
+
+	team = mm.lockedCreateTeam(teamID, now)
+
+	mm.events.Publish(events.Event{Kind: events.TeamCreated, TeamID: teamID})
+
+	return team, nil
+}
+
+func (mm *MutMap) lockedCreateTeam(teamID string, at time.Time) server.Team {
 	// If the team was not found, we insert
 	// a "zeroed" team with just the ID.
-	team.ID = teamID
+	team := server.Team{ID: teamID}
 	mm.teams[teamID] = team
+	mm.created[teamID] = at
+	mm.ranking.set(teamID, 0)
+	return team
+}
+
+// GetLeaderboard returns the highest scoring teams.
+func (mm *MutMap) GetLeaderboard(ctx context.Context) (server.Leaderboard, error) {
+	mm.mutex.RLock()
+	defer mm.mutex.RUnlock()
+
+	return mm.lockedLeaderboard(0, mm.ranking.len()), nil
+}
+
+// GetLeaderboardPage returns at most limit teams after the cursor (if any), skipping the offset highest scoring.
+func (mm *MutMap) GetLeaderboardPage(ctx context.Context, after *server.Cursor, offset, limit int) (server.Leaderboard, error) {
+	mm.mutex.RLock()
+	defer mm.mutex.RUnlock()
 
-	if mm.onNewTeam != nil {
-		mm.onNewTeam <- teamID
+	if after != nil {
+		offset += mm.ranking.countThrough(after.Clicks, after.TeamID)
 	}
+	return mm.lockedLeaderboard(offset, offset+limit), nil
+}
 
-	return team, nil
+// GetLeaderboardAround returns the given team and the n teams above and below it.
+func (mm *MutMap) GetLeaderboardAround(ctx context.Context, teamID string, n int) (server.Leaderboard, error) {
+	mm.mutex.RLock()
+	defer mm.mutex.RUnlock()
+
+	i, ok := mm.ranking.index(teamID)
+	if !ok {
+		return nil, server.ErrNotFound
+	}
+
+	start := i - n
+	if start < 0 {
+		start = 0
+	}
+
+	return mm.lockedLeaderboard(start, i+n+1), nil
 }
 
-// GetLeaderboard returns the highest scoring teams.
-func (mm *MutMap) GetLeaderboard() (server.Leaderboard, error) {
+// GetWindowLeaderboard returns the teams scoring the most during the last window of time.
+func (mm *MutMap) GetWindowLeaderboard(ctx context.Context, window time.Duration, offset, limit int) (server.Leaderboard, error) {
 	mm.mutex.RLock()
 	defer mm.mutex.RUnlock()
 
+	leaderboard := mm.windows.leaderboard(window, time.Now())
+	return pageOf(leaderboard, offset, limit), nil
+}
+
+// GetStanding returns the rank of the given team.
+func (mm *MutMap) GetStanding(ctx context.Context, teamID string) (server.Standing, error) {
+	mm.mutex.RLock()
+	defer mm.mutex.RUnlock()
+
+	team, ok := mm.teams[teamID]
+	if !ok {
+		return server.Standing{}, server.ErrNotFound
+	}
+
+	// teams with the same clicks share the rank of the first of them
+	i := mm.ranking.countAbove(team.Clicks)
+
+	standing := server.Standing{Rank: int64(i + 1)}
+	if 0 < i {
+		standing.ClicksToNextRank = mm.teams[mm.ranking.at(i-1)].Clicks - team.Clicks
+	}
+
+	return standing, nil
+}
+
+// lockedLeaderboard returns ranked teams in [start, end), teams without
+// clicks are not on the leaderboard
+func (mm *MutMap) lockedLeaderboard(start, end int) server.Leaderboard {
 	leaderboard := server.Leaderboard{}
 
-	for _, team := range mm.teams {
-		if 0 < team.Clicks {
-			leaderboard = append(leaderboard, team)
+	if mm.ranking.len() < end {
+		end = mm.ranking.len()
+	}
+	for i := start; i < end; i++ {
+		team := mm.teams[mm.ranking.at(i)]
+		if team.Clicks <= 0 {
+			break
 		}
+		leaderboard = append(leaderboard, team)
 	}
 
-	sort.Slice(leaderboard, func(i, j int) bool {
-		// more is less
-		return leaderboard[i].Clicks > leaderboard[j].Clicks
-	})
+	return leaderboard
+}
 
-	return leaderboard, nil
+// Flush syncs the journal, if the MutMap is durable.
+func (mm *MutMap) Flush(ctx context.Context) error {
+	if mm.journal == nil {
+		return nil
+	}
+	return mm.journal.sync()
+}
+
+// Ping always succeeds, the map is right here.
+func (mm *MutMap) Ping(ctx context.Context) error {
+	return nil
 }
 
 // RecordClicks stores clicks for the given team.
-func (mm *MutMap) RecordClicks(teamID string, count int64) (server.Team, error) {
+func (mm *MutMap) RecordClicks(ctx context.Context, teamID string, count int64) (server.Team, error) {
 	mm.mutex.Lock()
 	defer mm.mutex.Unlock()
 
-	// OnNewLeader: stash leader before updating clicks so we can know if it changed
-	var prevLeader server.Team
-	if mm.onNewLeader != nil {
-		prevLeader = mm.lockedFindLeader()
-	}
-
 	team, ok := mm.teams[teamID]
 	if !ok {
-		return team, errors.New("not found")
+		return team, server.ErrNotFound
+	}
+
+	now := time.Now()
+	err := mm.lockedJournal(journalEntry{Op: opClicks, TeamID: teamID, Count: count, At: now})
+	if err != nil {
+		return team, err
 	}
 
+	team, newLeader := mm.lockedAddClicks(teamID, count, now)
+
+	// publishing never blocks, so it is fine to do while holding the lock
+	if newLeader {
+		mm.events.Publish(events.Event{Kind: events.LeaderChanged, TeamID: teamID})
+	}
+	mm.events.Publish(events.Event{Kind: events.ClicksRecorded, TeamID: teamID, Count: count})
+
+	return team, nil
+}
+
+// lockedAddClicks also tells if the team took the lead
+func (mm *MutMap) lockedAddClicks(teamID string, count int64, at time.Time) (server.Team, bool) {
+	team := mm.teams[teamID]
 	team.Clicks += count
 	mm.teams[teamID] = team
+	mm.ranking.set(teamID, team.Clicks)
+	mm.windows.record(teamID, count, at)
 
-	// OnNewLeader: notify on new leader
-	if mm.onNewLeader != nil {
-		if prevLeader.Clicks < team.Clicks && prevLeader.ID != teamID {
-			mm.onNewLeader <- teamID
-		}
+	// there is no team with the empty ID, so that leader has no clicks
+	if teamID == mm.leader || team.Clicks <= mm.teams[mm.leader].Clicks {
+		return team, false
+	}
+	mm.leader = teamID
+	return team, true
+}
+
+// EndSeason archives the current standings and resets all clicks.
+func (mm *MutMap) EndSeason(ctx context.Context, season server.Season) error {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+
+	if _, ok := mm.seasonHistory[season.ID]; ok {
+		return server.ErrSeasonArchived
+	}
+
+	err := mm.lockedJournal(journalEntry{Op: opEndSeason, Season: &season, At: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	mm.lockedEndSeason(season)
+
+	return nil
+}
+
+func (mm *MutMap) lockedEndSeason(season server.Season) {
+	mm.seasons = append(mm.seasons, season)
+	mm.seasonHistory[season.ID] = mm.lockedLeaderboard(0, mm.ranking.len())
+
+	// with everyone at zero the ranking is just by ID
+	mm.ranking = newRanking()
+	for id, team := range mm.teams {
+		team.Clicks = 0
+		mm.teams[id] = team
+		mm.ranking.set(id, 0)
+	}
+	// teams without clicks don't lead
+	mm.leader = ""
+}
+
+// GetSeasons returns all ended seasons, oldest first.
+func (mm *MutMap) GetSeasons(ctx context.Context) ([]server.Season, error) {
+	mm.mutex.RLock()
+	defer mm.mutex.RUnlock()
+
+	seasons := make([]server.Season, len(mm.seasons))
+	copy(seasons, mm.seasons)
+	return seasons, nil
+}
+
+// GetSeasonLeaderboard returns the final standings of an ended season.
+func (mm *MutMap) GetSeasonLeaderboard(ctx context.Context, seasonID string) (server.Leaderboard, error) {
+	mm.mutex.RLock()
+	defer mm.mutex.RUnlock()
+
+	leaderboard, ok := mm.seasonHistory[seasonID]
+	if !ok {
+		return nil, server.ErrNotFound
+	}
+	return leaderboard, nil
+}
+
+// DeleteTeam removes a team and its clicks, archived seasons are kept as they were.
+func (mm *MutMap) DeleteTeam(ctx context.Context, teamID string) error {
+	_, err := mm.moderate(journalEntry{Op: opDelete, TeamID: teamID})
+	return err
+}
+
+// RenameTeam gives a team a new ID, merging it with any team already using it.
+func (mm *MutMap) RenameTeam(ctx context.Context, teamID, newID string) (server.Team, error) {
+	if teamID == newID {
+		return mm.FindByID(ctx, teamID)
+	}
+	return mm.moderate(journalEntry{Op: opRename, TeamID: teamID, NewID: newID})
+}
+
+// ResetTeam takes away all clicks from a team, also in the windowed leaderboards.
+func (mm *MutMap) ResetTeam(ctx context.Context, teamID string) (server.Team, error) {
+	return mm.moderate(journalEntry{Op: opReset, TeamID: teamID})
+}
+
+// AdjustClicks adds or takes away clicks from a team, it never gets less than zero.
+func (mm *MutMap) AdjustClicks(ctx context.Context, teamID string, count int64) (server.Team, error) {
+	return mm.moderate(journalEntry{Op: opAdjust, TeamID: teamID, Count: count})
+}
+
+// moderate journals and applies a moderation operation to an existing team
+func (mm *MutMap) moderate(e journalEntry) (server.Team, error) {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+
+	team, ok := mm.teams[e.TeamID]
+	if !ok {
+		return team, server.ErrNotFound
+	}
+
+	e.At = time.Now()
+	err := mm.lockedJournal(e)
+	if err != nil {
+		return team, err
+	}
+
+	team, newLeader := mm.lockedModerate(e)
+
+	mm.events.Publish(events.Event{Kind: events.TeamChanged, TeamID: e.TeamID})
+	if e.Op == opRename {
+		mm.events.Publish(events.Event{Kind: events.TeamChanged, TeamID: e.NewID})
+	}
+	if newLeader {
+		mm.events.Publish(events.Event{Kind: events.LeaderChanged, TeamID: mm.leader})
 	}
 
 	return team, nil
 }
 
-// locked as in you need to hold the lock when calling
-// returns a "zero" team if no leader is found
-func (mm *MutMap) lockedFindLeader() server.Team {
-	mostPoints := int64(-1)
-	leader := server.Team{}
-	for _, t := range mm.teams {
-		if mostPoints < t.Clicks {
-			leader = t
+// lockedModerate returns the changed team and tells if someone else took the lead
+func (mm *MutMap) lockedModerate(e journalEntry) (server.Team, bool) {
+	team := mm.teams[e.TeamID]
+	mm.ranking.remove(e.TeamID)
+
+	switch e.Op {
+	case opDelete:
+		delete(mm.teams, e.TeamID)
+		delete(mm.created, e.TeamID)
+		mm.windows.remove(e.TeamID)
+		return team, mm.lockedRecheckLeader()
+	case opRename:
+		delete(mm.teams, e.TeamID)
+		created := mm.created[e.TeamID]
+		delete(mm.created, e.TeamID)
+		if merged, ok := mm.teams[e.NewID]; ok {
+			mm.ranking.remove(e.NewID)
+			team.Clicks += merged.Clicks
+		} else {
+			mm.created[e.NewID] = created
+		}
+		mm.windows.rename(e.TeamID, e.NewID)
+		if mm.leader == e.TeamID {
+			// the lead is not lost by changing names
+			mm.leader = e.NewID
 		}
+		team.ID = e.NewID
+	case opReset:
+		team.Clicks = 0
+		mm.windows.remove(e.TeamID)
+	case opAdjust:
+		team.Clicks += e.Count
+		if team.Clicks < 0 {
+			team.Clicks = 0
+		}
+	}
+
+	mm.teams[team.ID] = team
+	mm.ranking.set(team.ID, team.Clicks)
+
+	return team, mm.lockedRecheckLeader()
+}
+
+// lockedRecheckLeader finds the leader after teams lost clicks or went away,
+// a remaining leader keeps the lead unless someone has more clicks.
+// It tells if another team took the lead.
+func (mm *MutMap) lockedRecheckLeader() bool {
+	top := ""
+	if 0 < mm.ranking.len() && 0 < mm.teams[mm.ranking.at(0)].Clicks {
+		top = mm.ranking.at(0)
+	}
+
+	leader, ok := mm.teams[mm.leader]
+	if top != "" && ok && mm.teams[top].Clicks <= leader.Clicks {
+		return false
+	}
+
+	changed := top != mm.leader
+	mm.leader = top
+	return changed && top != ""
+}
+
+// GetRecentTeams returns the most recently created teams, newest first.
+func (mm *MutMap) GetRecentTeams(ctx context.Context, limit int) ([]server.CreatedTeam, error) {
+	mm.mutex.RLock()
+	defer mm.mutex.RUnlock()
+
+	teams := make([]server.CreatedTeam, 0, len(mm.teams))
+	for id, team := range mm.teams {
+		teams = append(teams, server.CreatedTeam{Team: team, CreatedAt: mm.created[id]})
+	}
+	sortRecent(teams)
+
+	if limit < len(teams) {
+		teams = teams[:limit]
+	}
+	return teams, nil
+}
+
+// GetBans returns all bans, oldest first.
+func (mm *MutMap) GetBans(ctx context.Context) ([]server.Ban, error) {
+	mm.mutex.RLock()
+	defer mm.mutex.RUnlock()
+
+	bans := make([]server.Ban, len(mm.bans))
+	copy(bans, mm.bans)
+	return bans, nil
+}
+
+// AddBan adds a ban, replacing any ban with the same rule.
+func (mm *MutMap) AddBan(ctx context.Context, ban server.Ban) error {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+
+	err := mm.lockedJournal(journalEntry{Op: opBan, Ban: &ban, At: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	mm.lockedAddBan(ban)
+
+	mm.events.Publish(events.Event{Kind: events.BansChanged})
+
+	return nil
+}
+
+func (mm *MutMap) lockedAddBan(ban server.Ban) {
+	mm.lockedRemoveBan(ban.BanRule)
+	mm.bans = append(mm.bans, ban)
+}
+
+// RemoveBan removes the ban with the given rule.
+func (mm *MutMap) RemoveBan(ctx context.Context, rule server.BanRule) error {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+
+	if mm.lockedFindBan(rule) < 0 {
+		return server.ErrNotFound
+	}
+
+	err := mm.lockedJournal(journalEntry{Op: opUnban, Ban: &server.Ban{BanRule: rule}, At: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	mm.lockedRemoveBan(rule)
+
+	mm.events.Publish(events.Event{Kind: events.BansChanged})
+
+	return nil
+}
+
+// lockedRemoveBan tells if there was a ban with the rule to remove
+func (mm *MutMap) lockedRemoveBan(rule server.BanRule) bool {
+	i := mm.lockedFindBan(rule)
+	if i < 0 {
+		return false
+	}
+	mm.bans = append(mm.bans[:i:i], mm.bans[i+1:]...)
+	return true
+}
+
+// lockedFindBan returns the index of the ban with the rule, or -1
+func (mm *MutMap) lockedFindBan(rule server.BanRule) int {
+	for i, ban := range mm.bans {
+		if ban.BanRule == rule {
+			return i
+		}
+	}
+	return -1
+}
+
+// RecordAudit appends entries to the audit trail.
+func (mm *MutMap) RecordAudit(ctx context.Context, entries []server.AuditEntry) error {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+
+	// a journal entry must be small enough to replay, however many clicks were audited
+	for 0 < len(entries) {
+		chunk := entries
+		if auditChunkSize < len(chunk) {
+			chunk = chunk[:auditChunkSize]
+		}
+		entries = entries[len(chunk):]
+
+		err := mm.lockedJournal(journalEntry{Op: opAudit, Audit: chunk, At: time.Now()})
+		if err != nil {
+			return err
+		}
+		mm.lockedAppendAudit(chunk)
+	}
+
+	return nil
+}
+
+// auditChunkSize is the most audit entries journaled together
+var auditChunkSize = 100
+
+// lockedAppendAudit adds entries to the audit trail, forgetting the oldest
+// ones beyond MaxAuditEntries. Appending copies the kept entries to a new
+// array when the old one is full, so the forgotten ones are freed.
+func (mm *MutMap) lockedAppendAudit(entries []server.AuditEntry) {
+	mm.audit = append(mm.audit, entries...)
+	if over := len(mm.audit) - MaxAuditEntries; 0 < over {
+		mm.audit = mm.audit[over:]
+	}
+}
+
+// GetAudit returns the matching audit entries, newest first.
+func (mm *MutMap) GetAudit(ctx context.Context, filter server.AuditFilter) ([]server.AuditEntry, error) {
+	mm.mutex.RLock()
+	defer mm.mutex.RUnlock()
+
+	entries := []server.AuditEntry{}
+	for i := len(mm.audit) - 1; 0 <= i && len(entries) < filter.Limit; i-- {
+		if filter.Matches(mm.audit[i]) {
+			entries = append(entries, mm.audit[i])
+		}
+	}
+	return entries, nil
+}
+
+// sortRecent orders teams newest first, and by ID if created at the same time
+func sortRecent(teams []server.CreatedTeam) {
+	sort.Slice(teams, func(i, j int) bool {
+		if !teams[i].CreatedAt.Equal(teams[j].CreatedAt) {
+			return teams[i].CreatedAt.After(teams[j].CreatedAt)
+		}
+		return teams[i].ID < teams[j].ID
+	})
+}
+
+// pageOf returns the part of the leaderboard in [offset, offset+limit)
+func pageOf(leaderboard server.Leaderboard, offset, limit int) server.Leaderboard {
+	if len(leaderboard) < offset {
+		offset = len(leaderboard)
+	}
+	end := offset + limit
+	if len(leaderboard) < end {
+		end = len(leaderboard)
+	}
+	return leaderboard[offset:end]
+}
+
+// rankedBefore tells if a should be placed before b in the ranking
+func rankedBefore(a, b server.Team) bool {
+	if a.Clicks != b.Clicks {
+		return a.Clicks > b.Clicks
 	}
-	return leader
+	return a.ID < b.ID
 }
@@ -0,0 +1,165 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+
+	"github.com/fabjan/mmocg/events"
+)
+
+// electionInterval is how often a standby instance tries to become the
+// announcer, and so how long announcements can stop when it goes away.
+var electionInterval = 5 * time.Second
+
+// reconnectInterval is how long to wait before listening again after a failure.
+var reconnectInterval = 5 * time.Second
+
+// pgEventBacklog is how many team, leader and ban events can wait to be sent.
+var pgEventBacklog = 100
+
+// PgEvents shares store events between all instances using the same database.
+//
+// Events published on the local bus are sent with NOTIFY, and everything
+// received with LISTEN (including our own events) is published on the
+// cluster bus. The instance holding an advisory lock is elected to make
+// the announcements.
+type PgEvents struct {
+	// 1 if this instance holds the lock, first for atomic alignment
+	leading int32
+
+	db      *sql.DB
+	url     string
+	channel string
+	lockKey int64
+	local   *events.Bus
+	cluster *events.Bus
+}
+
+// NewPgEvents creates a fan-out for the store with the given table name.
+// The database URL is needed since listening requires a dedicated connection.
+func NewPgEvents(db *sql.DB, rawURL string, name string, local, cluster *events.Bus) *PgEvents {
+	h := fnv.New64a()
+	h.Write([]byte("mmocg/" + name))
+	return &PgEvents{
+		db:      db,
+		url:     rawURL,
+		channel: name + "_events",
+		lockKey: int64(h.Sum64()),
+		local:   local,
+		cluster: cluster,
+	}
+}
+
+// Leading tells if this instance should make the announcements.
+func (pe *PgEvents) Leading() bool {
+	return atomic.LoadInt32(&pe.leading) == 1
+}
+
+func (pe *PgEvents) setLeading(leading bool) {
+	var v int32
+	if leading {
+		v = 1
+	}
+	if atomic.SwapInt32(&pe.leading, v) != v {
+		log.Printf("announcer election: leading=%v", leading)
+	}
+}
+
+// Go starts sending and receiving events, it runs forever.
+func (pe *PgEvents) Go() {
+	// Team, leader and ban events are all worth sending, but clicks
+	// only tell the others to refresh so one pending is enough.
+	go pe.send(pe.local.Subscribe(pgEventBacklog, events.DropOldest, events.TeamCreated, events.LeaderChanged, events.TeamChanged, events.BansChanged))
+	go pe.send(pe.local.Subscribe(1, events.Coalesce, events.ClicksRecorded))
+
+	for {
+		err := pe.listen()
+		pe.setLeading(false)
+		log.Printf("event listener failed: %v", err)
+		time.Sleep(reconnectInterval)
+	}
+}
+
+func (pe *PgEvents) send(sub *events.Subscription) {
+	for e := range sub.C {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("can't encode event: %v", err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), electionInterval)
+		_, err = pe.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", pe.channel, string(payload))
+		cancel()
+		if err != nil {
+			log.Printf("can't send event: %v", err)
+		}
+	}
+}
+
+// listen receives events until the connection fails. The advisory lock
+// is held by the listening session, so it is released if we go away.
+func (pe *PgEvents) listen() error {
+	ctx := context.Background()
+
+	conn, err := pgx.Connect(ctx, pe.url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	_, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{pe.channel}.Sanitize())
+	if err != nil {
+		return err
+	}
+
+	for {
+		if !pe.Leading() {
+			var locked bool
+			err = conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", pe.lockKey).Scan(&locked)
+			if err != nil {
+				return err
+			}
+			pe.setLeading(locked)
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, electionInterval)
+		n, err := conn.WaitForNotification(waitCtx)
+		cancel()
+		if pgconn.Timeout(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var e events.Event
+		err = json.Unmarshal([]byte(n.Payload), &e)
+		if err != nil {
+			log.Printf("ignoring bad event %q: %v", n.Payload, err)
+			continue
+		}
+		pe.cluster.Publish(e)
+	}
+}
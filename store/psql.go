@@ -15,91 +15,321 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"sync"
+	"time"
 
 	_ "github.com/jackc/pgx/v4/stdlib" // for sql.Open("pgx", ...)
 
+	"github.com/fabjan/mmocg/events"
 	"github.com/fabjan/mmocg/server"
 )
 
 // Postgres is a postrges backed team score store.
 type Postgres struct {
-	db          *sql.DB
-	tableName   string
-	onNewTeam   chan string
-	onNewLeader chan string
+	db        *sql.DB
+	tableName string
+	events    *events.Bus
+
+	done       chan struct{}
+	background sync.WaitGroup
 }
 
+// BucketPruneInterval is how often expired buckets are deleted.
+var BucketPruneInterval = time.Minute
+
+// bucketPruneTimeout is how long pruning may take, the table can be large
+var bucketPruneTimeout = time.Minute
+
 // OpenPg opens a connection to the Postgres database with the given URL.
 func OpenPg(rawURL string) (*sql.DB, error) {
 	return sql.Open("pgx", rawURL)
 }
 
 // NewPostgres creates a Postgres backed by the given table and DB.
-// The table is created if it does not exist.
-func NewPostgres(db *sql.DB, name string, onNewTeam, onNewLeader chan string) (*Postgres, error) {
-	s := Postgres{
+// The schema is migrated to the latest version if needed.
+func NewPostgres(db *sql.DB, name string, bus *events.Bus) (*Postgres, error) {
+	s := &Postgres{
 		tableName: name,
 		db:        db,
+		done:      make(chan struct{}),
 	}
 
-	_, err := db.Exec(s.createTableSQL())
+	_, _, err := MigratePostgres(context.Background(), db, name)
 	if err != nil {
 		return nil, err
 	}
 
-	s.onNewTeam = onNewTeam
-	s.onNewLeader = onNewLeader
+	s.events = bus
 
-	return &s, nil
+	// pruning in the background keeps the deletes out of click requests
+	s.background.Add(1)
+	go s.pruneBuckets()
+
+	return s, nil
 }
 
 // Close closes the store (its database connection)
 func (s *Postgres) Close() {
+	close(s.done)
+	s.background.Wait()
 	s.db.Close()
 }
 
-func (s *Postgres) createTableSQL() string {
-	sql := `
-CREATE TABLE IF NOT EXISTS %s (
-	teamID TEXT NOT NULL,
-	clicks NUMERIC,
-	UNIQUE(teamID)
-);
-`
+// Flush does nothing, every write goes straight to the database.
+func (s *Postgres) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Ping checks that the database can be reached.
+func (s *Postgres) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *Postgres) selectPageSQL() string {
+	return fmt.Sprintf("SELECT teamID, clicks FROM %s WHERE clicks > 0 ORDER BY clicks DESC, teamID LIMIT $1 OFFSET $2", s.tableName)
+}
+
+func (s *Postgres) selectPageAfterSQL() string {
+	sql := `SELECT teamID, clicks FROM %s
+	WHERE (clicks < $3 OR (clicks = $3 AND teamID > $4)) AND clicks > 0
+	ORDER BY clicks DESC, teamID LIMIT $1 OFFSET $2`
 	return fmt.Sprintf(sql, s.tableName)
 }
 
-func (s *Postgres) selectAllSQL(limit int) string {
-	return fmt.Sprintf("SELECT teamID, clicks FROM %s ORDER BY clicks DESC LIMIT %d", s.tableName, limit)
+func (s *Postgres) selectAroundSQL() string {
+	// The ranking index is used for both sides, by walking it in opposite directions.
+	sql := `
+(SELECT teamID, clicks FROM %s
+	WHERE (clicks > $2 OR (clicks = $2 AND teamID < $1)) AND clicks > 0
+	ORDER BY clicks ASC, teamID DESC LIMIT $3)
+UNION ALL
+(SELECT teamID, clicks FROM %s
+	WHERE (clicks < $2 OR (clicks = $2 AND teamID >= $1)) AND clicks > 0
+	ORDER BY clicks DESC, teamID ASC LIMIT $3 + 1)
+`
+	return fmt.Sprintf(sql, s.tableName, s.tableName)
 }
 
 func (s *Postgres) selectOneSQL() string {
 	return fmt.Sprintf("SELECT teamID, clicks FROM %s WHERE teamID = $1 LIMIT 1", s.tableName)
 }
 
+func (s *Postgres) selectStandingSQL() string {
+	// both subqueries only scan the part of the ranking index above the team
+	sql := `
+SELECT
+	(SELECT COUNT(*) FROM %s WHERE clicks > $1) + 1,
+	COALESCE((SELECT MIN(clicks) FROM %s WHERE clicks > $1) - $1, 0)
+`
+	return fmt.Sprintf(sql, s.tableName, s.tableName)
+}
+
+func (s *Postgres) mergeTeamSQL() string {
+	sql := `
+INSERT INTO %s (teamID, clicks, createdAt)
+SELECT $2, clicks, createdAt FROM %s WHERE teamID = $1
+ON CONFLICT (teamID) DO UPDATE SET clicks = %s.clicks + EXCLUDED.clicks
+`
+	return fmt.Sprintf(sql, s.tableName, s.tableName, s.tableName)
+}
+
+func (s *Postgres) mergeBucketsSQL() string {
+	sql := `
+INSERT INTO %s_buckets (resolution, bucket, teamID, clicks)
+SELECT resolution, bucket, $2, clicks FROM %s_buckets WHERE teamID = $1
+ON CONFLICT (resolution, bucket, teamID) DO UPDATE SET clicks = %s_buckets.clicks + EXCLUDED.clicks
+`
+	return fmt.Sprintf(sql, s.tableName, s.tableName, s.tableName)
+}
+
 func (s *Postgres) selectLeaderSQL() string {
-	return fmt.Sprintf("SELECT teamID, clicks FROM %s ORDER BY clicks DESC LIMIT 1", s.tableName)
+	// moderation locks the leader row, like clicks taking the lead do
+	return fmt.Sprintf("SELECT teamID, clicks FROM %s_leader FOR UPDATE", s.tableName)
 }
 
-func (s *Postgres) upsertSQL() string {
-	// We have a specific create operation in the API, so perhaps upserting is a bit bad.
+func (s *Postgres) updateLeaderSQL() string {
+	return fmt.Sprintf("UPDATE %s_leader SET previous = teamID, teamID = $1, clicks = $2", s.tableName)
+}
+
+func (s *Postgres) selectRecentSQL() string {
+	return fmt.Sprintf("SELECT teamID, clicks, createdAt FROM %s ORDER BY createdAt DESC, teamID LIMIT $1", s.tableName)
+}
+
+func (s *Postgres) upsertBanSQL() string {
 	sql := `
-INSERT INTO %s (teamID, clicks) VALUES ($1, $2)
-ON CONFLICT (teamID) DO UPDATE SET clicks = %s.clicks + $2
+INSERT INTO %s_bans (kind, value, reason, createdAt) VALUES ($1, $2, $3, $4)
+ON CONFLICT (kind, value) DO UPDATE SET reason = EXCLUDED.reason, createdAt = EXCLUDED.createdAt
+`
+	return fmt.Sprintf(sql, s.tableName)
+}
+
+func (s *Postgres) deleteBanSQL() string {
+	return fmt.Sprintf("DELETE FROM %s_bans WHERE kind = $1 AND value = $2", s.tableName)
+}
+
+func (s *Postgres) selectBansSQL() string {
+	return fmt.Sprintf("SELECT kind, value, reason, createdAt FROM %s_bans ORDER BY createdAt, kind, value", s.tableName)
+}
+
+func (s *Postgres) insertAuditSQL() string {
+	sql := `
+INSERT INTO %s_audit (at, action, actor, teamID, count, detail, sourceIP, requestID)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+`
+	return fmt.Sprintf(sql, s.tableName)
+}
+
+func (s *Postgres) selectAuditSQL() string {
+	sql := `
+SELECT at, action, actor, teamID, count, detail, sourceIP, requestID FROM %s_audit
+WHERE ($1 = '' OR action = $1) AND ($2 = '' OR actor = $2)
+AND ($3 = '' OR teamID = $3) AND ($4 = '' OR sourceIP = $4)
+AND ($5::timestamptz IS NULL OR $5 <= at) AND ($6::timestamptz IS NULL OR at < $6)
+ORDER BY id DESC LIMIT $7
+`
+	return fmt.Sprintf(sql, s.tableName)
+}
+
+func (s *Postgres) insertSeasonSQL() string {
+	sql := `
+INSERT INTO %s_seasons (seasonID, startsAt, endsAt) VALUES ($1, $2, $3)
+ON CONFLICT (seasonID) DO NOTHING
+`
+	return fmt.Sprintf(sql, s.tableName)
+}
+
+func (s *Postgres) archiveSeasonSQL() string {
+	sql := `
+INSERT INTO %s_history (seasonID, teamID, clicks)
+SELECT $1, teamID, clicks FROM %s WHERE clicks > 0
+`
+	return fmt.Sprintf(sql, s.tableName, s.tableName)
+}
+
+func (s *Postgres) selectSeasonsSQL() string {
+	return fmt.Sprintf("SELECT seasonID, startsAt, endsAt FROM %s_seasons ORDER BY endsAt", s.tableName)
+}
+
+func (s *Postgres) selectSeasonSQL() string {
+	return fmt.Sprintf("SELECT seasonID FROM %s_seasons WHERE seasonID = $1", s.tableName)
+}
+
+func (s *Postgres) selectHistorySQL() string {
+	sql := "SELECT teamID, clicks FROM %s_history WHERE seasonID = $1 ORDER BY clicks DESC, teamID"
+	return fmt.Sprintf(sql, s.tableName)
+}
+
+// Clicks are bucketed by the minute for the short windows
+// and by the hour for the long ones.
+var pgBucketResolutions = []struct {
+	name    string
+	retains time.Duration
+}{
+	{"minute", time.Hour},
+	{"hour", MaxWindow},
+}
+
+func (s *Postgres) upsertBucketsSQL() string {
+	sql := `
+INSERT INTO %s_buckets (resolution, bucket, teamID, clicks) VALUES
+	('minute', date_trunc('minute', now()), $1, $2),
+	('hour', date_trunc('hour', now()), $1, $2)
+ON CONFLICT (resolution, bucket, teamID) DO UPDATE SET clicks = %s_buckets.clicks + EXCLUDED.clicks
 `
 	return fmt.Sprintf(sql, s.tableName, s.tableName)
 }
 
+func (s *Postgres) selectWindowSQL() string {
+	// include every bucket overlapping the window, like MutMap does
+	sql := `
+SELECT teamID, SUM(clicks) AS total FROM %s_buckets
+WHERE resolution = $1 AND date_trunc($1, now() - $2::float8 * interval '1 second') <= bucket
+GROUP BY teamID
+ORDER BY total DESC, teamID
+LIMIT $3 OFFSET $4
+`
+	return fmt.Sprintf(sql, s.tableName)
+}
+
+func (s *Postgres) pruneBucketsSQL() string {
+	sql := `
+DELETE FROM %s_buckets
+WHERE resolution = $1 AND bucket < date_trunc($1, now() - $2::float8 * interval '1 second')
+`
+	return fmt.Sprintf(sql, s.tableName)
+}
+
+func (s *Postgres) clickSQL() string {
+	// The leader row is only updated (and locked) when the team passes it,
+	// concurrent updates wait for the lock and then recheck the condition,
+	// so each lead change is seen by exactly one click.
+	sql := `
+WITH team AS (
+	UPDATE %s SET clicks = clicks + $2 WHERE teamID = $1
+	RETURNING teamID, clicks
+), leader AS (
+	UPDATE %s_leader AS l SET previous = l.teamID, teamID = team.teamID, clicks = team.clicks
+	FROM team WHERE l.clicks < team.clicks
+	RETURNING l.previous <> l.teamID AS changed
+)
+SELECT team.teamID, team.clicks, COALESCE((SELECT changed FROM leader), FALSE) FROM team
+`
+	return fmt.Sprintf(sql, s.tableName, s.tableName)
+}
+
+func (s *Postgres) clickBatchSQL() string {
+	// like clickSQL, but only the top team of the batch can take the lead
+	sql := `
+WITH team AS (
+	UPDATE %s AS t SET clicks = t.clicks + batch.count
+	FROM unnest($1::text[], $2::bigint[]) AS batch (teamID, count)
+	WHERE t.teamID = batch.teamID
+	RETURNING t.teamID, t.clicks
+), top AS (
+	SELECT teamID, clicks FROM team ORDER BY clicks DESC, teamID LIMIT 1
+), leader AS (
+	UPDATE %s_leader AS l SET previous = l.teamID, teamID = top.teamID, clicks = top.clicks
+	FROM top WHERE l.clicks < top.clicks
+	RETURNING l.teamID, l.previous <> l.teamID AS changed
+)
+SELECT team.teamID, team.clicks, COALESCE(leader.changed, FALSE)
+FROM team LEFT JOIN leader ON leader.teamID = team.teamID
+`
+	return fmt.Sprintf(sql, s.tableName, s.tableName)
+}
+
+func (s *Postgres) upsertBucketBatchSQL() string {
+	sql := `
+INSERT INTO %s_buckets (resolution, bucket, teamID, clicks)
+SELECT res.name, date_trunc(res.name, now()), batch.teamID, batch.count
+FROM unnest($1::text[], $2::bigint[]) AS batch (teamID, count)
+CROSS JOIN (VALUES ('minute'), ('hour')) AS res (name)
+ON CONFLICT (resolution, bucket, teamID) DO UPDATE SET clicks = %s_buckets.clicks + EXCLUDED.clicks
+`
+	return fmt.Sprintf(sql, s.tableName, s.tableName)
+}
+
+func (s *Postgres) resetLeaderSQL() string {
+	// teams without clicks don't lead, so whoever scores first takes the lead
+	return fmt.Sprintf("UPDATE %s_leader SET previous = teamID, teamID = '', clicks = 0", s.tableName)
+}
+
+func (s *Postgres) insertSQL() string {
+	return fmt.Sprintf("INSERT INTO %s (teamID, clicks) VALUES ($1, 0) ON CONFLICT (teamID) DO NOTHING", s.tableName)
+}
+
 // FindByID returns a single team if found by ID.
-func (s *Postgres) FindByID(teamID string) (server.Team, error) {
+func (s *Postgres) FindByID(ctx context.Context, teamID string) (server.Team, error) {
 
 	team := server.Team{}
 
-	rows, err := s.db.Query(s.selectOneSQL(), teamID)
+	rows, err := s.db.QueryContext(ctx, s.selectOneSQL(), teamID)
 	if err != nil {
 		return team, err
 	}
@@ -117,20 +347,20 @@ func (s *Postgres) FindByID(teamID string) (server.Team, error) {
 	}
 
 	if team.ID == "" {
-		return team, errors.New("team not found")
+		return team, server.ErrNotFound
 	}
 
 	return team, nil
 }
 
 // CreateTeam creates a new team, an error means the ID is taken.
-func (s *Postgres) CreateTeam(teamID string) (server.Team, error) {
+func (s *Postgres) CreateTeam(ctx context.Context, teamID string) (server.Team, error) {
 
 	team := server.Team{
 		ID: teamID,
 	}
 
-	res, err := s.db.Exec(s.upsertSQL(), teamID, 0)
+	res, err := s.db.ExecContext(ctx, s.insertSQL(), teamID)
 	if err != nil {
 		return team, err
 	}
@@ -139,28 +369,136 @@ func (s *Postgres) CreateTeam(teamID string) (server.Team, error) {
 		return team, err
 	}
 	if rows != 1 {
-		return team, errors.New("no rows updated")
+		team, err = s.FindByID(ctx, teamID)
+		if err != nil {
+			return team, err
+		}
+		return team, errors.New("exists")
 	}
 
-	if s.onNewTeam != nil {
-		s.onNewTeam <- teamID
-	}
+	s.events.Publish(events.Event{Kind: events.TeamCreated, TeamID: teamID})
 
 	return team, nil
 }
 
 // GetLeaderboard returns the highest scoring teams.
-func (s *Postgres) GetLeaderboard() (server.Leaderboard, error) {
+func (s *Postgres) GetLeaderboard(ctx context.Context) (server.Leaderboard, error) {
+	return s.GetLeaderboardPage(ctx, nil, 0, server.MaxLeaderboardSize)
+}
 
-	leaderboard := server.Leaderboard{}
+// GetLeaderboardPage returns at most limit teams after the cursor (if any), skipping the offset highest scoring.
+func (s *Postgres) GetLeaderboardPage(ctx context.Context, after *server.Cursor, offset, limit int) (server.Leaderboard, error) {
+	var rows *sql.Rows
+	var err error
+	if after == nil {
+		rows, err = s.db.QueryContext(ctx, s.selectPageSQL(), limit, offset)
+	} else {
+		rows, err = s.db.QueryContext(ctx, s.selectPageAfterSQL(), limit, offset, after.Clicks, after.TeamID)
+	}
+	if err != nil {
+		return server.Leaderboard{}, err
+	}
 
-	// 640 rows ought to be enough for anyone
-	rows, err := s.db.Query(s.selectAllSQL(640))
+	// the database already sorted it for us
+	return scanLeaderboard(rows)
+}
+
+// GetLeaderboardAround returns the given team and the n teams above and below it.
+func (s *Postgres) GetLeaderboardAround(ctx context.Context, teamID string, n int) (server.Leaderboard, error) {
+	team, err := s.FindByID(ctx, teamID)
+	if err != nil {
+		return server.Leaderboard{}, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.selectAroundSQL(), team.ID, team.Clicks, n)
+	if err != nil {
+		return server.Leaderboard{}, err
+	}
+
+	leaderboard, err := scanLeaderboard(rows)
 	if err != nil {
 		return leaderboard, err
 	}
+
+	// the teams above were fetched closest first
+	sort.Slice(leaderboard, func(i, j int) bool {
+		return rankedBefore(leaderboard[i], leaderboard[j])
+	})
+
+	return leaderboard, nil
+}
+
+// GetWindowLeaderboard returns the teams scoring the most during the last window of time.
+func (s *Postgres) GetWindowLeaderboard(ctx context.Context, window time.Duration, offset, limit int) (server.Leaderboard, error) {
+	resolution := pgBucketResolutions[len(pgBucketResolutions)-1].name
+	for _, res := range pgBucketResolutions {
+		if window <= res.retains {
+			resolution = res.name
+			break
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.selectWindowSQL(), resolution, window.Seconds(), limit, offset)
+	if err != nil {
+		return server.Leaderboard{}, err
+	}
+
+	return scanLeaderboard(rows)
+}
+
+// pruneBuckets deletes expired buckets every BucketPruneInterval, until the store is closed
+func (s *Postgres) pruneBuckets() {
+	defer s.background.Done()
+
+	ticker := time.NewTicker(BucketPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		s.pruneExpiredBuckets()
+	}
+}
+
+func (s *Postgres) pruneExpiredBuckets() {
+	ctx, cancel := context.WithTimeout(context.Background(), bucketPruneTimeout)
+	defer cancel()
+
+	for _, res := range pgBucketResolutions {
+		_, err := s.db.ExecContext(ctx, s.pruneBucketsSQL(), res.name, res.retains.Seconds())
+		if err != nil {
+			log.Printf("can't prune %s buckets: %v", res.name, err)
+		}
+	}
+}
+
+// GetStanding returns the rank of the given team.
+func (s *Postgres) GetStanding(ctx context.Context, teamID string) (server.Standing, error) {
+	standing := server.Standing{}
+
+	team, err := s.FindByID(ctx, teamID)
+	if err != nil {
+		return standing, err
+	}
+
+	row := s.db.QueryRowContext(ctx, s.selectStandingSQL(), team.Clicks)
+	err = row.Scan(&standing.Rank, &standing.ClicksToNextRank)
+	if err != nil {
+		return standing, err
+	}
+
+	return standing, nil
+}
+
+// scanLeaderboard reads all teams from the rows and closes them.
+func scanLeaderboard(rows *sql.Rows) (server.Leaderboard, error) {
 	defer rows.Close()
 
+	leaderboard := server.Leaderboard{}
+
 	team := server.Team{}
 	for rows.Next() {
 		err := rows.Scan(&team.ID, &team.Clicks)
@@ -169,72 +507,447 @@ func (s *Postgres) GetLeaderboard() (server.Leaderboard, error) {
 		}
 		leaderboard = append(leaderboard, team)
 	}
-	err = rows.Err()
+	err := rows.Err()
 	if err != nil {
 		return leaderboard, err
 	}
 
-	// the database already sorted it for us
 	return leaderboard, nil
 }
 
 // RecordClicks stores clicks for the given team.
-func (s *Postgres) RecordClicks(teamID string, count int64) (server.Team, error) {
+func (s *Postgres) RecordClicks(ctx context.Context, teamID string, count int64) (server.Team, error) {
+
+	team := server.Team{}
+
+	var newLeader bool
+	row := s.db.QueryRowContext(ctx, s.clickSQL(), teamID, count)
+	err := row.Scan(&team.ID, &team.Clicks, &newLeader)
+	if err == sql.ErrNoRows {
+		return team, server.ErrNotFound
+	}
+	if err != nil {
+		return team, fmt.Errorf("can't record clicks: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, s.upsertBucketsSQL(), teamID, count)
+	if err != nil {
+		// the team's clicks are safe, only the windowed leaderboards are off
+		log.Printf("can't record clicks in buckets: %v", err)
+	}
+
+	if newLeader {
+		s.events.Publish(events.Event{Kind: events.LeaderChanged, TeamID: teamID})
+	}
+	s.events.Publish(events.Event{Kind: events.ClicksRecorded, TeamID: teamID, Count: count})
+
+	return team, nil
+}
+
+// recordClickBatch adds clicks to several teams at once, returning their new
+// totals. Unknown teams are ignored. Events are published like RecordClicks does.
+func (s *Postgres) recordClickBatch(ctx context.Context, teamIDs []string, counts []int64) (server.Leaderboard, error) {
+	teams := server.Leaderboard{}
 
+	rows, err := s.db.QueryContext(ctx, s.clickBatchSQL(), teamIDs, counts)
+	if err != nil {
+		return teams, fmt.Errorf("can't record clicks: %w", err)
+	}
+	defer rows.Close()
+
+	var newLeader string
 	team := server.Team{}
+	for rows.Next() {
+		var changed bool
+		err := rows.Scan(&team.ID, &team.Clicks, &changed)
+		if err != nil {
+			return teams, err
+		}
+		if changed {
+			newLeader = team.ID
+		}
+		teams = append(teams, team)
+	}
+	err = rows.Err()
+	if err != nil {
+		return teams, err
+	}
 
-	prevLeader, err := s.findLeader()
+	_, err = s.db.ExecContext(ctx, s.upsertBucketBatchSQL(), teamIDs, counts)
 	if err != nil {
-		log.Printf("no leader found, expected only if no teams played yet")
+		// the team's clicks are safe, only the windowed leaderboards are off
+		log.Printf("can't record clicks in buckets: %v", err)
+	}
+
+	if newLeader != "" {
+		s.events.Publish(events.Event{Kind: events.LeaderChanged, TeamID: newLeader})
 	}
+	batch := make(map[string]int64, len(teamIDs))
+	for i, teamID := range teamIDs {
+		batch[teamID] = counts[i]
+	}
+	for _, team := range teams {
+		s.events.Publish(events.Event{Kind: events.ClicksRecorded, TeamID: team.ID, Count: batch[team.ID]})
+	}
+
+	return teams, nil
+}
+
+// EndSeason archives the current standings and resets all clicks.
+func (s *Postgres) EndSeason(ctx context.Context, season server.Season) error {
 
-	res, err := s.db.Exec(s.upsertSQL(), teamID, count)
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return team, fmt.Errorf("can't insert team: %w", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, s.insertSeasonSQL(), season.ID, season.Start, season.End)
+	if err != nil {
+		return fmt.Errorf("can't insert season: %w", err)
 	}
 	rows, err := res.RowsAffected()
 	if err != nil {
-		return team, fmt.Errorf("can't count affected rows: %w", err)
+		return fmt.Errorf("can't count affected rows: %w", err)
 	}
-	if rows < 1 {
-		return team, fmt.Errorf("no rows updated: %w", err)
+	if rows != 1 {
+		return server.ErrSeasonArchived
 	}
 
-	team, err = s.FindByID(teamID)
+	// Block clicks until we're done, so none are reset without being archived.
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("LOCK TABLE %s IN EXCLUSIVE MODE", s.tableName))
+	if err != nil {
+		return fmt.Errorf("can't lock teams: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, s.archiveSeasonSQL(), season.ID)
 	if err != nil {
-		return team, fmt.Errorf("can't find updated team: %w", err)
+		return fmt.Errorf("can't archive standings: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET clicks = 0", s.tableName))
+	if err != nil {
+		return fmt.Errorf("can't reset clicks: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, s.resetLeaderSQL())
+	if err != nil {
+		return fmt.Errorf("can't reset leader: %w", err)
 	}
 
-	if s.onNewLeader != nil {
-		if prevLeader.Clicks < team.Clicks && prevLeader.ID != teamID {
-			s.onNewLeader <- teamID
+	return tx.Commit()
+}
+
+// GetSeasons returns all ended seasons, oldest first.
+func (s *Postgres) GetSeasons(ctx context.Context) ([]server.Season, error) {
+
+	seasons := []server.Season{}
+
+	rows, err := s.db.QueryContext(ctx, s.selectSeasonsSQL())
+	if err != nil {
+		return seasons, err
+	}
+	defer rows.Close()
+
+	season := server.Season{}
+	for rows.Next() {
+		err := rows.Scan(&season.ID, &season.Start, &season.End)
+		if err != nil {
+			return seasons, err
 		}
+		seasons = append(seasons, season)
+	}
+	err = rows.Err()
+	if err != nil {
+		return seasons, err
+	}
+
+	return seasons, nil
+}
+
+// GetSeasonLeaderboard returns the final standings of an ended season.
+func (s *Postgres) GetSeasonLeaderboard(ctx context.Context, seasonID string) (server.Leaderboard, error) {
+
+	var id string
+	err := s.db.QueryRowContext(ctx, s.selectSeasonSQL(), seasonID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return server.Leaderboard{}, server.ErrNotFound
+	}
+	if err != nil {
+		return server.Leaderboard{}, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.selectHistorySQL(), seasonID)
+	if err != nil {
+		return server.Leaderboard{}, err
+	}
+
+	return scanLeaderboard(rows)
+}
+
+// DeleteTeam removes a team and its clicks, archived seasons are kept as they were.
+func (s *Postgres) DeleteTeam(ctx context.Context, teamID string) error {
+	_, err := s.moderate(ctx, teamID, "", func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE teamID = $1", s.tableName), teamID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s_buckets WHERE teamID = $1", s.tableName), teamID)
+		return err
+	})
+	return err
+}
+
+// RenameTeam gives a team a new ID, merging it with any team already using it.
+func (s *Postgres) RenameTeam(ctx context.Context, teamID, newID string) (server.Team, error) {
+	if teamID == newID {
+		return s.FindByID(ctx, teamID)
+	}
+	return s.moderate(ctx, teamID, newID, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, s.mergeTeamSQL(), teamID, newID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE teamID = $1", s.tableName), teamID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, s.mergeBucketsSQL(), teamID, newID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s_buckets WHERE teamID = $1", s.tableName), teamID)
+		return err
+	})
+}
+
+// ResetTeam takes away all clicks from a team, also in the windowed leaderboards.
+func (s *Postgres) ResetTeam(ctx context.Context, teamID string) (server.Team, error) {
+	return s.moderate(ctx, teamID, teamID, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET clicks = 0 WHERE teamID = $1", s.tableName), teamID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s_buckets WHERE teamID = $1", s.tableName), teamID)
+		return err
+	})
+}
+
+// AdjustClicks adds or takes away clicks from a team, it never gets less than zero.
+func (s *Postgres) AdjustClicks(ctx context.Context, teamID string, count int64) (server.Team, error) {
+	return s.moderate(ctx, teamID, teamID, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET clicks = GREATEST(clicks + $2, 0) WHERE teamID = $1", s.tableName), teamID, count)
+		return err
+	})
+}
+
+// moderate changes an existing team in a transaction and publishes the events.
+// The changed team is returned, unless it was deleted (newID is empty).
+func (s *Postgres) moderate(ctx context.Context, teamID, newID string, change func(tx *sql.Tx) error) (server.Team, error) {
+
+	team := server.Team{}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return team, err
+	}
+	defer tx.Rollback()
+
+	// lock the team, so no clicks sneak in before it is changed
+	lockSQL := fmt.Sprintf("SELECT teamID, clicks FROM %s WHERE teamID = $1 FOR UPDATE", s.tableName)
+	err = tx.QueryRowContext(ctx, lockSQL, teamID).Scan(&team.ID, &team.Clicks)
+	if err == sql.ErrNoRows {
+		return team, server.ErrNotFound
+	}
+	if err != nil {
+		return team, err
+	}
+
+	err = change(tx)
+	if err != nil {
+		return team, fmt.Errorf("can't change team: %w", err)
+	}
+
+	if newID != "" {
+		err = tx.QueryRowContext(ctx, s.selectOneSQL(), newID).Scan(&team.ID, &team.Clicks)
+		if err != nil {
+			return team, fmt.Errorf("can't find changed team: %w", err)
+		}
+	}
+
+	newLeader, err := s.recheckLeader(ctx, tx, teamID, newID)
+	if err != nil {
+		return team, fmt.Errorf("can't update leader: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return team, err
+	}
+
+	s.events.Publish(events.Event{Kind: events.TeamChanged, TeamID: teamID})
+	if newID != "" && newID != teamID {
+		s.events.Publish(events.Event{Kind: events.TeamChanged, TeamID: newID})
+	}
+	if newLeader != "" {
+		s.events.Publish(events.Event{Kind: events.LeaderChanged, TeamID: newLeader})
 	}
 
 	return team, nil
 }
 
-func (s *Postgres) findLeader() (server.Team, error) {
+// recheckLeader finds the leader after a team was changed, a remaining leader
+// keeps the lead unless someone has more clicks, and a renamed one keeps it
+// under the new ID. It returns the team that took the lead, if another one did.
+func (s *Postgres) recheckLeader(ctx context.Context, tx *sql.Tx, teamID, newID string) (string, error) {
 	leader := server.Team{}
+	err := tx.QueryRowContext(ctx, s.selectLeaderSQL()).Scan(&leader.ID, &leader.Clicks)
+	if err != nil {
+		return "", err
+	}
+	if leader.ID == teamID && newID != "" {
+		leader.ID = newID
+	}
+
+	top := server.Team{}
+	err = tx.QueryRowContext(ctx, s.selectPageSQL(), 1, 0).Scan(&top.ID, &top.Clicks)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	current := server.Team{}
+	err = tx.QueryRowContext(ctx, s.selectOneSQL(), leader.ID).Scan(&current.ID, &current.Clicks)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	if top.ID != "" && current.ID != "" && top.Clicks <= current.Clicks {
+		// the leader's clicks are kept up to date, so others know what to beat
+		_, err = tx.ExecContext(ctx, s.updateLeaderSQL(), current.ID, current.Clicks)
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, s.updateLeaderSQL(), top.ID, top.Clicks)
+	if err != nil || top.ID == leader.ID {
+		return "", err
+	}
+	return top.ID, nil
+}
 
-	rows, err := s.db.Query(s.selectLeaderSQL())
+// GetRecentTeams returns the most recently created teams, newest first.
+func (s *Postgres) GetRecentTeams(ctx context.Context, limit int) ([]server.CreatedTeam, error) {
+
+	teams := []server.CreatedTeam{}
+
+	rows, err := s.db.QueryContext(ctx, s.selectRecentSQL(), limit)
 	if err != nil {
-		return leader, err
+		return teams, err
 	}
 	defer rows.Close()
 
-	// the leader query returns at most one row
 	for rows.Next() {
-		err := rows.Scan(&leader.ID, &leader.Clicks)
+		var team server.CreatedTeam
+		err := rows.Scan(&team.ID, &team.Clicks, &team.CreatedAt)
 		if err != nil {
-			return leader, err
+			return teams, err
 		}
+		teams = append(teams, team)
 	}
-	err = rows.Err()
+
+	return teams, rows.Err()
+}
+
+// GetBans returns all bans, oldest first.
+func (s *Postgres) GetBans(ctx context.Context) ([]server.Ban, error) {
+
+	bans := []server.Ban{}
+
+	rows, err := s.db.QueryContext(ctx, s.selectBansSQL())
+	if err != nil {
+		return bans, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ban server.Ban
+		err := rows.Scan(&ban.Match, &ban.Value, &ban.Reason, &ban.CreatedAt)
+		if err != nil {
+			return bans, err
+		}
+		bans = append(bans, ban)
+	}
+
+	return bans, rows.Err()
+}
+
+// AddBan adds a ban, replacing any ban with the same rule.
+func (s *Postgres) AddBan(ctx context.Context, ban server.Ban) error {
+	_, err := s.db.ExecContext(ctx, s.upsertBanSQL(), ban.Match, ban.Value, ban.Reason, ban.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	s.events.Publish(events.Event{Kind: events.BansChanged})
+
+	return nil
+}
+
+// RemoveBan removes the ban with the given rule.
+func (s *Postgres) RemoveBan(ctx context.Context, rule server.BanRule) error {
+	res, err := s.db.ExecContext(ctx, s.deleteBanSQL(), rule.Match, rule.Value)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return server.ErrNotFound
+	}
+
+	s.events.Publish(events.Event{Kind: events.BansChanged})
+
+	return nil
+}
+
+// RecordAudit appends entries to the audit trail.
+func (s *Postgres) RecordAudit(ctx context.Context, entries []server.AuditEntry) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return leader, err
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, e := range entries {
+		_, err := tx.ExecContext(ctx, s.insertAuditSQL(), e.At, e.Action, e.Actor, e.TeamID, e.Count, e.Detail, e.SourceIP, e.RequestID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetAudit returns the matching audit entries, newest first.
+func (s *Postgres) GetAudit(ctx context.Context, filter server.AuditFilter) ([]server.AuditEntry, error) {
+
+	entries := []server.AuditEntry{}
+
+	since := sql.NullTime{Time: filter.Since, Valid: !filter.Since.IsZero()}
+	until := sql.NullTime{Time: filter.Until, Valid: !filter.Until.IsZero()}
+	rows, err := s.db.QueryContext(ctx, s.selectAuditSQL(), filter.Action, filter.Actor, filter.TeamID, filter.SourceIP, since, until, filter.Limit)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e server.AuditEntry
+		err := rows.Scan(&e.At, &e.Action, &e.Actor, &e.TeamID, &e.Count, &e.Detail, &e.SourceIP, &e.RequestID)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, e)
 	}
 
-	// if no leader was found we will return a "zero" team
-	return leader, nil
+	return entries, rows.Err()
 }
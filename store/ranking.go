@@ -0,0 +1,221 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"math/rand"
+)
+
+// ranking orders team IDs by clicks (descending), ties are ordered by ID.
+// It is a treap where every node counts the nodes below it, so placing,
+// moving and finding a team, or the team at some place, is O(log n).
+type ranking struct {
+	root  *rankNode
+	nodes map[string]*rankNode
+}
+
+type rankNode struct {
+	id     string
+	clicks int64
+	// priority keeps the tree balanced, parents have higher priorities
+	priority    uint32
+	size        int
+	left, right *rankNode
+}
+
+func newRanking() *ranking {
+	return &ranking{nodes: make(map[string]*rankNode)}
+}
+
+// len tells how many teams are ranked
+func (r *ranking) len() int {
+	return r.root.count()
+}
+
+// set places the team by its clicks, moving it if it is already ranked
+func (r *ranking) set(teamID string, clicks int64) {
+	r.remove(teamID)
+	n := &rankNode{id: teamID, clicks: clicks, priority: rand.Uint32(), size: 1}
+	r.nodes[teamID] = n
+	r.root = insertNode(r.root, n)
+}
+
+// remove takes the team out of the ranking, if it is there
+func (r *ranking) remove(teamID string) {
+	n, ok := r.nodes[teamID]
+	if !ok {
+		return
+	}
+	delete(r.nodes, teamID)
+	r.root = removeNode(r.root, n)
+}
+
+// index returns the place (from 0) of the team
+func (r *ranking) index(teamID string) (int, bool) {
+	n, ok := r.nodes[teamID]
+	if !ok {
+		return 0, false
+	}
+	return r.countBefore(n), true
+}
+
+// countAbove tells how many teams have more than the given clicks
+func (r *ranking) countAbove(clicks int64) int {
+	// no team has the empty ID, so this is before all teams with the clicks
+	return r.countBefore(&rankNode{clicks: clicks})
+}
+
+// countThrough tells how many teams are ranked before or at the given
+// clicks and team ID, whether or not that team is still ranked there
+func (r *ranking) countThrough(clicks int64, teamID string) int {
+	// a new node is never found in the tree, so equal nodes are counted
+	return r.countBefore(&rankNode{clicks: clicks, id: teamID})
+}
+
+// countBefore tells how many teams are ranked before the node
+func (r *ranking) countBefore(n *rankNode) int {
+	i := 0
+	t := r.root
+	for t != nil {
+		if t == n {
+			return i + t.left.count()
+		}
+		if nodeBefore(n, t) {
+			t = t.left
+		} else {
+			i += t.left.count() + 1
+			t = t.right
+		}
+	}
+	return i
+}
+
+// at returns the team at the given place, which must be in [0, len)
+func (r *ranking) at(i int) string {
+	t := r.root
+	for {
+		left := t.left.count()
+		switch {
+		case i < left:
+			t = t.left
+		case i == left:
+			return t.id
+		default:
+			i -= left + 1
+			t = t.right
+		}
+	}
+}
+
+// ids returns all ranked team IDs in order
+func (r *ranking) ids() []string {
+	ids := make([]string, 0, r.len())
+	var walk func(t *rankNode)
+	walk = func(t *rankNode) {
+		if t == nil {
+			return
+		}
+		walk(t.left)
+		ids = append(ids, t.id)
+		walk(t.right)
+	}
+	walk(r.root)
+	return ids
+}
+
+func (t *rankNode) count() int {
+	if t == nil {
+		return 0
+	}
+	return t.size
+}
+
+func (t *rankNode) recount() {
+	t.size = 1 + t.left.count() + t.right.count()
+}
+
+// nodeBefore tells if a is ranked before b, like rankedBefore
+func nodeBefore(a, b *rankNode) bool {
+	if a.clicks != b.clicks {
+		return a.clicks > b.clicks
+	}
+	return a.id < b.id
+}
+
+func insertNode(t, n *rankNode) *rankNode {
+	if t == nil {
+		return n
+	}
+	if t.priority < n.priority {
+		n.left, n.right = splitNodes(t, n)
+		n.recount()
+		return n
+	}
+	if nodeBefore(n, t) {
+		t.left = insertNode(t.left, n)
+	} else {
+		t.right = insertNode(t.right, n)
+	}
+	t.recount()
+	return t
+}
+
+func removeNode(t, n *rankNode) *rankNode {
+	if t == n {
+		return mergeNodes(t.left, t.right)
+	}
+	if nodeBefore(n, t) {
+		t.left = removeNode(t.left, n)
+	} else {
+		t.right = removeNode(t.right, n)
+	}
+	t.recount()
+	return t
+}
+
+// splitNodes splits the tree into the nodes ranked before n and the rest
+func splitNodes(t, n *rankNode) (*rankNode, *rankNode) {
+	if t == nil {
+		return nil, nil
+	}
+	if nodeBefore(t, n) {
+		before, rest := splitNodes(t.right, n)
+		t.right = before
+		t.recount()
+		return t, rest
+	}
+	before, rest := splitNodes(t.left, n)
+	t.left = rest
+	t.recount()
+	return before, t
+}
+
+// mergeNodes joins two trees, all nodes in a must be ranked before those in b
+func mergeNodes(a, b *rankNode) *rankNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if b.priority < a.priority {
+		a.right = mergeNodes(a.right, b)
+		a.recount()
+		return a
+	}
+	b.left = mergeNodes(a, b.left)
+	b.recount()
+	return b
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/fabjan/mmocg/server"
+)
+
+func TestRanking(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	r := newRanking()
+	teams := map[string]int64{}
+
+	for step := 0; step < 5000; step++ {
+		id := fmt.Sprintf("team%d", rng.Intn(200))
+		if rng.Intn(10) == 0 {
+			r.remove(id)
+			delete(teams, id)
+		} else {
+			// few distinct click counts, so there are many ties
+			clicks := rng.Int63n(20)
+			r.set(id, clicks)
+			teams[id] = clicks
+		}
+	}
+
+	var want []server.Team
+	for id, clicks := range teams {
+		want = append(want, server.Team{ID: id, Clicks: clicks})
+	}
+	sort.Slice(want, func(i, j int) bool { return rankedBefore(want[i], want[j]) })
+	var wantIDs []string
+	for _, team := range want {
+		wantIDs = append(wantIDs, team.ID)
+	}
+
+	if got := r.ids(); !reflect.DeepEqual(got, wantIDs) {
+		t.Fatalf("ranked %v, want %v", got, wantIDs)
+	}
+	if r.len() != len(want) {
+		t.Fatalf("len %d, want %d", r.len(), len(want))
+	}
+	for i, team := range want {
+		if got := r.at(i); got != team.ID {
+			t.Errorf("at(%d) = %s, want %s", i, got, team.ID)
+		}
+		if got, ok := r.index(team.ID); !ok || got != i {
+			t.Errorf("index(%s) = %d, %v, want %d", team.ID, got, ok, i)
+		}
+		above := sort.Search(len(want), func(j int) bool { return want[j].Clicks <= team.Clicks })
+		if got := r.countAbove(team.Clicks); got != above {
+			t.Errorf("countAbove(%d) = %d, want %d", team.Clicks, got, above)
+		}
+	}
+	if _, ok := r.index("nobody"); ok {
+		t.Errorf("found a team never ranked")
+	}
+}
@@ -0,0 +1,959 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // for sql.Open("sqlite3", ...)
+
+	"github.com/fabjan/mmocg/events"
+	"github.com/fabjan/mmocg/server"
+)
+
+// SQLite is an SQLite backed team score store.
+type SQLite struct {
+	db        *sql.DB
+	tableName string
+	events    *events.Bus
+
+	done       chan struct{}
+	background sync.WaitGroup
+}
+
+// SQLiteScheme is the URL scheme for SQLite database URLs.
+const SQLiteScheme = "sqlite://"
+
+// OpenSQLite opens the SQLite database with the given URL,
+// e.g. sqlite:///var/lib/mmocg.db or sqlite://relative/path.db
+func OpenSQLite(rawURL string) (*sql.DB, error) {
+	if !strings.HasPrefix(rawURL, SQLiteScheme) {
+		return nil, fmt.Errorf("not an sqlite URL: %s", rawURL)
+	}
+	path := strings.TrimPrefix(rawURL, SQLiteScheme)
+	if path == "" {
+		return nil, errors.New("no sqlite database path")
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only has one writer anyway, and with a single connection
+	// every transaction is serialized without any busy errors.
+	db.SetMaxOpenConns(1)
+
+	return db, nil
+}
+
+// NewSQLite creates an SQLite backed by the given table and DB.
+// The table is created if it does not exist.
+func NewSQLite(db *sql.DB, name string, bus *events.Bus) (*SQLite, error) {
+	s := &SQLite{
+		tableName: name,
+		db:        db,
+		done:      make(chan struct{}),
+	}
+
+	_, err := db.Exec(s.createTableSQL())
+	if err != nil {
+		return nil, err
+	}
+	err = s.addCreatedAt(db)
+	if err != nil {
+		return nil, err
+	}
+
+	s.events = bus
+
+	// pruning in the background keeps the deletes out of click requests
+	s.background.Add(1)
+	go s.pruneBuckets()
+
+	return s, nil
+}
+
+// Close closes the store (its database connection)
+func (s *SQLite) Close() {
+	close(s.done)
+	s.background.Wait()
+	s.db.Close()
+}
+
+// Flush does nothing, every write goes straight to the database.
+func (s *SQLite) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Ping checks that the database can be reached.
+func (s *SQLite) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *SQLite) createTableSQL() string {
+	sql := `
+CREATE TABLE IF NOT EXISTS %s (
+	teamID TEXT NOT NULL PRIMARY KEY,
+	clicks INTEGER NOT NULL DEFAULT 0,
+	createdAt INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS %s_ranking ON %s (clicks DESC, teamID);
+CREATE TABLE IF NOT EXISTS %s_seasons (
+	seasonID TEXT NOT NULL PRIMARY KEY,
+	startsAt INTEGER NOT NULL,
+	endsAt INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS %s_history (
+	seasonID TEXT NOT NULL REFERENCES %s_seasons (seasonID),
+	teamID TEXT NOT NULL,
+	clicks INTEGER NOT NULL,
+	PRIMARY KEY (seasonID, teamID)
+);
+CREATE TABLE IF NOT EXISTS %s_buckets (
+	resolution INTEGER NOT NULL,
+	bucket INTEGER NOT NULL,
+	teamID TEXT NOT NULL,
+	clicks INTEGER NOT NULL,
+	PRIMARY KEY (resolution, bucket, teamID)
+);
+CREATE TABLE IF NOT EXISTS %s_leader (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	teamID TEXT NOT NULL,
+	clicks INTEGER NOT NULL
+);
+INSERT OR IGNORE INTO %s_leader (id, teamID, clicks)
+SELECT 1, COALESCE(MIN(teamID), ''), COALESCE(MIN(clicks), 0)
+FROM (SELECT teamID, clicks FROM %s WHERE clicks > 0 ORDER BY clicks DESC, teamID LIMIT 1);
+CREATE TABLE IF NOT EXISTS %s_bans (
+	kind TEXT NOT NULL,
+	value TEXT NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	createdAt INTEGER NOT NULL,
+	PRIMARY KEY (kind, value)
+);
+CREATE TABLE IF NOT EXISTS %s_audit (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	at INTEGER NOT NULL,
+	action TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	teamID TEXT NOT NULL DEFAULT '',
+	count INTEGER NOT NULL DEFAULT 0,
+	detail TEXT NOT NULL DEFAULT '',
+	sourceIP TEXT NOT NULL DEFAULT '',
+	requestID TEXT NOT NULL DEFAULT ''
+);
+`
+	t := s.tableName
+	return fmt.Sprintf(sql, t, t, t, t, t, t, t, t, t, t, t, t)
+}
+
+// addCreatedAt adds the createdAt column to tables created before teams
+// had creation times, those teams are treated as created long ago
+func (s *SQLite) addCreatedAt(db *sql.DB) error {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?1) WHERE name = 'createdAt'", s.tableName).Scan(&count)
+	if err != nil || 0 < count {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN createdAt INTEGER NOT NULL DEFAULT 0", s.tableName))
+	return err
+}
+
+func (s *SQLite) insertSQL() string {
+	return fmt.Sprintf("INSERT INTO %s (teamID, clicks, createdAt) VALUES (?1, 0, ?2) ON CONFLICT (teamID) DO NOTHING", s.tableName)
+}
+
+func (s *SQLite) addClicksSQL() string {
+	return fmt.Sprintf("UPDATE %s SET clicks = clicks + ?2 WHERE teamID = ?1", s.tableName)
+}
+
+func (s *SQLite) selectOneSQL() string {
+	return fmt.Sprintf("SELECT teamID, clicks FROM %s WHERE teamID = ?1", s.tableName)
+}
+
+func (s *SQLite) selectLeaderSQL() string {
+	return fmt.Sprintf("SELECT teamID, clicks FROM %s_leader", s.tableName)
+}
+
+func (s *SQLite) updateLeaderSQL() string {
+	return fmt.Sprintf("UPDATE %s_leader SET teamID = ?1, clicks = ?2", s.tableName)
+}
+
+func (s *SQLite) selectPageSQL() string {
+	return fmt.Sprintf("SELECT teamID, clicks FROM %s WHERE clicks > 0 ORDER BY clicks DESC, teamID LIMIT ?1 OFFSET ?2", s.tableName)
+}
+
+func (s *SQLite) selectPageAfterSQL() string {
+	sql := `SELECT teamID, clicks FROM %s
+	WHERE (clicks < ?3 OR (clicks = ?3 AND teamID > ?4)) AND clicks > 0
+	ORDER BY clicks DESC, teamID LIMIT ?1 OFFSET ?2`
+	return fmt.Sprintf(sql, s.tableName)
+}
+
+func (s *SQLite) selectAroundSQL() string {
+	sql := `
+SELECT * FROM (SELECT teamID, clicks FROM %s
+	WHERE (clicks > ?2 OR (clicks = ?2 AND teamID < ?1)) AND clicks > 0
+	ORDER BY clicks ASC, teamID DESC LIMIT ?3)
+UNION ALL
+SELECT * FROM (SELECT teamID, clicks FROM %s
+	WHERE (clicks < ?2 OR (clicks = ?2 AND teamID >= ?1)) AND clicks > 0
+	ORDER BY clicks DESC, teamID ASC LIMIT ?3 + 1)
+`
+	return fmt.Sprintf(sql, s.tableName, s.tableName)
+}
+
+func (s *SQLite) selectStandingSQL() string {
+	sql := `
+SELECT
+	(SELECT COUNT(*) FROM %s WHERE clicks > ?1) + 1,
+	COALESCE((SELECT MIN(clicks) FROM %s WHERE clicks > ?1) - ?1, 0)
+`
+	return fmt.Sprintf(sql, s.tableName, s.tableName)
+}
+
+func (s *SQLite) upsertBucketSQL() string {
+	sql := `
+INSERT INTO %s_buckets (resolution, bucket, teamID, clicks) VALUES (?1, ?2, ?3, ?4)
+ON CONFLICT (resolution, bucket, teamID) DO UPDATE SET clicks = clicks + excluded.clicks
+`
+	return fmt.Sprintf(sql, s.tableName)
+}
+
+func (s *SQLite) pruneBucketsSQL() string {
+	return fmt.Sprintf("DELETE FROM %s_buckets WHERE resolution = ?1 AND bucket < ?2", s.tableName)
+}
+
+func (s *SQLite) selectWindowSQL() string {
+	sql := `
+SELECT teamID, SUM(clicks) AS total FROM %s_buckets
+WHERE resolution = ?1 AND ?2 <= bucket
+GROUP BY teamID
+ORDER BY total DESC, teamID
+LIMIT ?3 OFFSET ?4
+`
+	return fmt.Sprintf(sql, s.tableName)
+}
+
+func (s *SQLite) mergeTeamSQL() string {
+	sql := `
+INSERT INTO %s (teamID, clicks, createdAt)
+SELECT ?2, clicks, createdAt FROM %s WHERE teamID = ?1
+ON CONFLICT (teamID) DO UPDATE SET clicks = clicks + excluded.clicks
+`
+	return fmt.Sprintf(sql, s.tableName, s.tableName)
+}
+
+func (s *SQLite) mergeBucketsSQL() string {
+	// WHERE is needed to tell the upsert from a join
+	sql := `
+INSERT INTO %s_buckets (resolution, bucket, teamID, clicks)
+SELECT resolution, bucket, ?2, clicks FROM %s_buckets WHERE teamID = ?1
+ON CONFLICT (resolution, bucket, teamID) DO UPDATE SET clicks = clicks + excluded.clicks
+`
+	return fmt.Sprintf(sql, s.tableName, s.tableName)
+}
+
+func (s *SQLite) selectRecentSQL() string {
+	return fmt.Sprintf("SELECT teamID, clicks, createdAt FROM %s ORDER BY createdAt DESC, teamID LIMIT ?1", s.tableName)
+}
+
+func (s *SQLite) replaceBanSQL() string {
+	return fmt.Sprintf("INSERT OR REPLACE INTO %s_bans (kind, value, reason, createdAt) VALUES (?1, ?2, ?3, ?4)", s.tableName)
+}
+
+func (s *SQLite) deleteBanSQL() string {
+	return fmt.Sprintf("DELETE FROM %s_bans WHERE kind = ?1 AND value = ?2", s.tableName)
+}
+
+// bans replaced by INSERT OR REPLACE get a new rowid, so they come last
+func (s *SQLite) selectBansSQL() string {
+	return fmt.Sprintf("SELECT kind, value, reason, createdAt FROM %s_bans ORDER BY createdAt, rowid", s.tableName)
+}
+
+func (s *SQLite) insertAuditSQL() string {
+	sql := `
+INSERT INTO %s_audit (at, action, actor, teamID, count, detail, sourceIP, requestID)
+VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8)
+`
+	return fmt.Sprintf(sql, s.tableName)
+}
+
+func (s *SQLite) selectAuditSQL() string {
+	sql := `
+SELECT at, action, actor, teamID, count, detail, sourceIP, requestID FROM %s_audit
+WHERE (?1 = '' OR action = ?1) AND (?2 = '' OR actor = ?2)
+AND (?3 = '' OR teamID = ?3) AND (?4 = '' OR sourceIP = ?4)
+AND (?5 IS NULL OR ?5 <= at) AND (?6 IS NULL OR at < ?6)
+ORDER BY id DESC LIMIT ?7
+`
+	return fmt.Sprintf(sql, s.tableName)
+}
+
+func (s *SQLite) insertSeasonSQL() string {
+	sql := `
+INSERT INTO %s_seasons (seasonID, startsAt, endsAt) VALUES (?1, ?2, ?3)
+ON CONFLICT (seasonID) DO NOTHING
+`
+	return fmt.Sprintf(sql, s.tableName)
+}
+
+func (s *SQLite) archiveSeasonSQL() string {
+	sql := `
+INSERT INTO %s_history (seasonID, teamID, clicks)
+SELECT ?1, teamID, clicks FROM %s WHERE clicks > 0
+`
+	return fmt.Sprintf(sql, s.tableName, s.tableName)
+}
+
+func (s *SQLite) selectSeasonsSQL() string {
+	return fmt.Sprintf("SELECT seasonID, startsAt, endsAt FROM %s_seasons ORDER BY endsAt", s.tableName)
+}
+
+func (s *SQLite) selectSeasonSQL() string {
+	return fmt.Sprintf("SELECT seasonID FROM %s_seasons WHERE seasonID = ?1", s.tableName)
+}
+
+func (s *SQLite) selectHistorySQL() string {
+	sql := "SELECT teamID, clicks FROM %s_history WHERE seasonID = ?1 ORDER BY clicks DESC, teamID"
+	return fmt.Sprintf(sql, s.tableName)
+}
+
+// FindByID returns a single team if found by ID.
+func (s *SQLite) FindByID(ctx context.Context, teamID string) (server.Team, error) {
+	return s.findByID(ctx, s.db, teamID)
+}
+
+// queryer is what we need from a *sql.DB or *sql.Tx
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (s *SQLite) findByID(ctx context.Context, q queryer, teamID string) (server.Team, error) {
+	team := server.Team{}
+
+	err := q.QueryRowContext(ctx, s.selectOneSQL(), teamID).Scan(&team.ID, &team.Clicks)
+	if err == sql.ErrNoRows {
+		return team, server.ErrNotFound
+	}
+	if err != nil {
+		return team, err
+	}
+
+	return team, nil
+}
+
+// CreateTeam creates a new team, an error means the ID is taken.
+func (s *SQLite) CreateTeam(ctx context.Context, teamID string) (server.Team, error) {
+
+	team := server.Team{
+		ID: teamID,
+	}
+
+	res, err := s.db.ExecContext(ctx, s.insertSQL(), teamID, time.Now().Unix())
+	if err != nil {
+		return team, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return team, err
+	}
+	if rows != 1 {
+		team, err = s.FindByID(ctx, teamID)
+		if err != nil {
+			return team, err
+		}
+		return team, errors.New("exists")
+	}
+
+	s.events.Publish(events.Event{Kind: events.TeamCreated, TeamID: teamID})
+
+	return team, nil
+}
+
+// GetLeaderboard returns the highest scoring teams.
+func (s *SQLite) GetLeaderboard(ctx context.Context) (server.Leaderboard, error) {
+	return s.GetLeaderboardPage(ctx, nil, 0, server.MaxLeaderboardSize)
+}
+
+// GetLeaderboardPage returns at most limit teams after the cursor (if any), skipping the offset highest scoring.
+func (s *SQLite) GetLeaderboardPage(ctx context.Context, after *server.Cursor, offset, limit int) (server.Leaderboard, error) {
+	var rows *sql.Rows
+	var err error
+	if after == nil {
+		rows, err = s.db.QueryContext(ctx, s.selectPageSQL(), limit, offset)
+	} else {
+		rows, err = s.db.QueryContext(ctx, s.selectPageAfterSQL(), limit, offset, after.Clicks, after.TeamID)
+	}
+	if err != nil {
+		return server.Leaderboard{}, err
+	}
+
+	return scanLeaderboard(rows)
+}
+
+// GetLeaderboardAround returns the given team and the n teams above and below it.
+func (s *SQLite) GetLeaderboardAround(ctx context.Context, teamID string, n int) (server.Leaderboard, error) {
+	team, err := s.FindByID(ctx, teamID)
+	if err != nil {
+		return server.Leaderboard{}, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.selectAroundSQL(), team.ID, team.Clicks, n)
+	if err != nil {
+		return server.Leaderboard{}, err
+	}
+
+	leaderboard, err := scanLeaderboard(rows)
+	if err != nil {
+		return leaderboard, err
+	}
+
+	// the teams above were fetched closest first
+	sort.Slice(leaderboard, func(i, j int) bool {
+		return rankedBefore(leaderboard[i], leaderboard[j])
+	})
+
+	return leaderboard, nil
+}
+
+// GetWindowLeaderboard returns the teams scoring the most during the last window of time.
+func (s *SQLite) GetWindowLeaderboard(ctx context.Context, window time.Duration, offset, limit int) (server.Leaderboard, error) {
+	res := bucketResolutions[len(bucketResolutions)-1]
+	for _, r := range bucketResolutions {
+		if window <= r.width*time.Duration(r.count) {
+			res = r
+			break
+		}
+	}
+
+	from := time.Now().Add(-window).Truncate(res.width).Unix()
+	rows, err := s.db.QueryContext(ctx, s.selectWindowSQL(), int64(res.width/time.Second), from, limit, offset)
+	if err != nil {
+		return server.Leaderboard{}, err
+	}
+
+	return scanLeaderboard(rows)
+}
+
+// GetStanding returns the rank of the given team.
+func (s *SQLite) GetStanding(ctx context.Context, teamID string) (server.Standing, error) {
+	standing := server.Standing{}
+
+	team, err := s.FindByID(ctx, teamID)
+	if err != nil {
+		return standing, err
+	}
+
+	row := s.db.QueryRowContext(ctx, s.selectStandingSQL(), team.Clicks)
+	err = row.Scan(&standing.Rank, &standing.ClicksToNextRank)
+	if err != nil {
+		return standing, err
+	}
+
+	return standing, nil
+}
+
+// RecordClicks stores clicks for the given team.
+func (s *SQLite) RecordClicks(ctx context.Context, teamID string, count int64) (server.Team, error) {
+
+	team := server.Team{}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return team, err
+	}
+	defer tx.Rollback()
+
+	prevLeader, err := s.findLeader(ctx, tx)
+	if err != nil {
+		return team, fmt.Errorf("can't find leader: %w", err)
+	}
+
+	res, err := tx.ExecContext(ctx, s.addClicksSQL(), teamID, count)
+	if err != nil {
+		return team, fmt.Errorf("can't update team: %w", err)
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return team, fmt.Errorf("can't count affected rows: %w", err)
+	}
+	if rows < 1 {
+		return team, server.ErrNotFound
+	}
+
+	team, err = s.findByID(ctx, tx, teamID)
+	if err != nil {
+		return team, fmt.Errorf("can't find updated team: %w", err)
+	}
+
+	// ties don't take the lead, but the leader's clicks are kept up to date
+	newLeader := false
+	if prevLeader.Clicks < team.Clicks {
+		_, err = tx.ExecContext(ctx, s.updateLeaderSQL(), teamID, team.Clicks)
+		if err != nil {
+			return team, fmt.Errorf("can't update leader: %w", err)
+		}
+		newLeader = prevLeader.ID != teamID
+	}
+
+	now := time.Now()
+	for _, res := range bucketResolutions {
+		bucket := now.Truncate(res.width).Unix()
+		_, err = tx.ExecContext(ctx, s.upsertBucketSQL(), int64(res.width/time.Second), bucket, teamID, count)
+		if err != nil {
+			// the clicks still count, only the windowed leaderboards miss them
+			log.Printf("can't record clicks in buckets: %v", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return team, err
+	}
+
+	if newLeader {
+		s.events.Publish(events.Event{Kind: events.LeaderChanged, TeamID: teamID})
+	}
+	s.events.Publish(events.Event{Kind: events.ClicksRecorded, TeamID: teamID, Count: count})
+
+	return team, nil
+}
+
+// pruneBuckets deletes expired buckets every BucketPruneInterval, until the store is closed
+func (s *SQLite) pruneBuckets() {
+	defer s.background.Done()
+
+	ticker := time.NewTicker(BucketPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		s.pruneExpiredBuckets(time.Now())
+	}
+}
+
+func (s *SQLite) pruneExpiredBuckets(now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), bucketPruneTimeout)
+	defer cancel()
+
+	for _, res := range bucketResolutions {
+		expired := now.Add(-res.width * time.Duration(res.count)).Truncate(res.width).Unix()
+		_, err := s.db.ExecContext(ctx, s.pruneBucketsSQL(), int64(res.width/time.Second), expired)
+		if err != nil {
+			log.Printf("can't prune %v buckets: %v", res.width, err)
+		}
+	}
+}
+
+// EndSeason archives the current standings and resets all clicks.
+func (s *SQLite) EndSeason(ctx context.Context, season server.Season) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, s.insertSeasonSQL(), season.ID, season.Start.Unix(), season.End.Unix())
+	if err != nil {
+		return fmt.Errorf("can't insert season: %w", err)
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("can't count affected rows: %w", err)
+	}
+	if rows != 1 {
+		return server.ErrSeasonArchived
+	}
+
+	_, err = tx.ExecContext(ctx, s.archiveSeasonSQL(), season.ID)
+	if err != nil {
+		return fmt.Errorf("can't archive standings: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET clicks = 0", s.tableName))
+	if err != nil {
+		return fmt.Errorf("can't reset clicks: %w", err)
+	}
+	// teams without clicks don't lead
+	_, err = tx.ExecContext(ctx, s.updateLeaderSQL(), "", 0)
+	if err != nil {
+		return fmt.Errorf("can't reset leader: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// GetSeasons returns all ended seasons, oldest first.
+func (s *SQLite) GetSeasons(ctx context.Context) ([]server.Season, error) {
+
+	seasons := []server.Season{}
+
+	rows, err := s.db.QueryContext(ctx, s.selectSeasonsSQL())
+	if err != nil {
+		return seasons, err
+	}
+	defer rows.Close()
+
+	var id string
+	var start, end int64
+	for rows.Next() {
+		err := rows.Scan(&id, &start, &end)
+		if err != nil {
+			return seasons, err
+		}
+		seasons = append(seasons, server.Season{
+			ID:    id,
+			Start: time.Unix(start, 0).UTC(),
+			End:   time.Unix(end, 0).UTC(),
+		})
+	}
+	err = rows.Err()
+	if err != nil {
+		return seasons, err
+	}
+
+	return seasons, nil
+}
+
+// GetSeasonLeaderboard returns the final standings of an ended season.
+func (s *SQLite) GetSeasonLeaderboard(ctx context.Context, seasonID string) (server.Leaderboard, error) {
+
+	var id string
+	err := s.db.QueryRowContext(ctx, s.selectSeasonSQL(), seasonID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return server.Leaderboard{}, server.ErrNotFound
+	}
+	if err != nil {
+		return server.Leaderboard{}, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.selectHistorySQL(), seasonID)
+	if err != nil {
+		return server.Leaderboard{}, err
+	}
+
+	return scanLeaderboard(rows)
+}
+
+// DeleteTeam removes a team and its clicks, archived seasons are kept as they were.
+func (s *SQLite) DeleteTeam(ctx context.Context, teamID string) error {
+	_, err := s.moderate(ctx, teamID, "", func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE teamID = ?1", s.tableName), teamID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s_buckets WHERE teamID = ?1", s.tableName), teamID)
+		return err
+	})
+	return err
+}
+
+// RenameTeam gives a team a new ID, merging it with any team already using it.
+func (s *SQLite) RenameTeam(ctx context.Context, teamID, newID string) (server.Team, error) {
+	if teamID == newID {
+		return s.FindByID(ctx, teamID)
+	}
+	return s.moderate(ctx, teamID, newID, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, s.mergeTeamSQL(), teamID, newID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE teamID = ?1", s.tableName), teamID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, s.mergeBucketsSQL(), teamID, newID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s_buckets WHERE teamID = ?1", s.tableName), teamID)
+		if err != nil {
+			return err
+		}
+		// the lead is not lost by changing names
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s_leader SET teamID = ?2 WHERE teamID = ?1", s.tableName), teamID, newID)
+		return err
+	})
+}
+
+// ResetTeam takes away all clicks from a team, also in the windowed leaderboards.
+func (s *SQLite) ResetTeam(ctx context.Context, teamID string) (server.Team, error) {
+	return s.moderate(ctx, teamID, teamID, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET clicks = 0 WHERE teamID = ?1", s.tableName), teamID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s_buckets WHERE teamID = ?1", s.tableName), teamID)
+		return err
+	})
+}
+
+// AdjustClicks adds or takes away clicks from a team, it never gets less than zero.
+func (s *SQLite) AdjustClicks(ctx context.Context, teamID string, count int64) (server.Team, error) {
+	return s.moderate(ctx, teamID, teamID, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET clicks = MAX(clicks + ?2, 0) WHERE teamID = ?1", s.tableName), teamID, count)
+		return err
+	})
+}
+
+// moderate changes an existing team in a transaction and publishes the events.
+// The changed team is returned, unless it was deleted (newID is empty).
+func (s *SQLite) moderate(ctx context.Context, teamID, newID string, change func(tx *sql.Tx) error) (server.Team, error) {
+
+	team := server.Team{}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return team, err
+	}
+	defer tx.Rollback()
+
+	team, err = s.findByID(ctx, tx, teamID)
+	if err != nil {
+		return team, err
+	}
+
+	err = change(tx)
+	if err != nil {
+		return team, fmt.Errorf("can't change team: %w", err)
+	}
+
+	if newID != "" {
+		team, err = s.findByID(ctx, tx, newID)
+		if err != nil {
+			return team, fmt.Errorf("can't find changed team: %w", err)
+		}
+	}
+
+	newLeader, err := s.recheckLeader(ctx, tx)
+	if err != nil {
+		return team, fmt.Errorf("can't update leader: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return team, err
+	}
+
+	s.events.Publish(events.Event{Kind: events.TeamChanged, TeamID: teamID})
+	if newID != "" && newID != teamID {
+		s.events.Publish(events.Event{Kind: events.TeamChanged, TeamID: newID})
+	}
+	if newLeader != "" {
+		s.events.Publish(events.Event{Kind: events.LeaderChanged, TeamID: newLeader})
+	}
+
+	return team, nil
+}
+
+// recheckLeader finds the leader after teams lost clicks or went away,
+// a remaining leader keeps the lead unless someone has more clicks.
+// It returns the team that took the lead, if another one did.
+func (s *SQLite) recheckLeader(ctx context.Context, tx *sql.Tx) (string, error) {
+	leader, err := s.findLeader(ctx, tx)
+	if err != nil {
+		return "", err
+	}
+
+	top := server.Team{}
+	err = tx.QueryRowContext(ctx, s.selectPageSQL(), 1, 0).Scan(&top.ID, &top.Clicks)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	current := server.Team{}
+	err = tx.QueryRowContext(ctx, s.selectOneSQL(), leader.ID).Scan(&current.ID, &current.Clicks)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	if top.ID != "" && current.ID != "" && top.Clicks <= current.Clicks {
+		// the leader's clicks are kept up to date
+		_, err = tx.ExecContext(ctx, s.updateLeaderSQL(), current.ID, current.Clicks)
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, s.updateLeaderSQL(), top.ID, top.Clicks)
+	if err != nil || top.ID == leader.ID {
+		return "", err
+	}
+	return top.ID, nil
+}
+
+// GetRecentTeams returns the most recently created teams, newest first.
+func (s *SQLite) GetRecentTeams(ctx context.Context, limit int) ([]server.CreatedTeam, error) {
+
+	teams := []server.CreatedTeam{}
+
+	rows, err := s.db.QueryContext(ctx, s.selectRecentSQL(), limit)
+	if err != nil {
+		return teams, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var team server.CreatedTeam
+		var createdAt int64
+		err := rows.Scan(&team.ID, &team.Clicks, &createdAt)
+		if err != nil {
+			return teams, err
+		}
+		team.CreatedAt = time.Unix(createdAt, 0).UTC()
+		teams = append(teams, team)
+	}
+
+	return teams, rows.Err()
+}
+
+// findLeader returns the team in the lead, a "zero" team if no team has any clicks
+func (s *SQLite) findLeader(ctx context.Context, q queryer) (server.Team, error) {
+	leader := server.Team{}
+
+	err := q.QueryRowContext(ctx, s.selectLeaderSQL()).Scan(&leader.ID, &leader.Clicks)
+	if err == sql.ErrNoRows {
+		return leader, nil
+	}
+	if err != nil {
+		return leader, err
+	}
+
+	return leader, nil
+}
+
+// GetBans returns all bans, oldest first.
+func (s *SQLite) GetBans(ctx context.Context) ([]server.Ban, error) {
+
+	bans := []server.Ban{}
+
+	rows, err := s.db.QueryContext(ctx, s.selectBansSQL())
+	if err != nil {
+		return bans, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ban server.Ban
+		var createdAt int64
+		err := rows.Scan(&ban.Match, &ban.Value, &ban.Reason, &createdAt)
+		if err != nil {
+			return bans, err
+		}
+		ban.CreatedAt = time.Unix(createdAt, 0).UTC()
+		bans = append(bans, ban)
+	}
+	err = rows.Err()
+	if err != nil {
+		return bans, err
+	}
+
+	return bans, nil
+}
+
+// AddBan adds a ban, replacing any ban with the same rule.
+func (s *SQLite) AddBan(ctx context.Context, ban server.Ban) error {
+	_, err := s.db.ExecContext(ctx, s.replaceBanSQL(), ban.Match, ban.Value, ban.Reason, ban.CreatedAt.Unix())
+	if err != nil {
+		return err
+	}
+
+	s.events.Publish(events.Event{Kind: events.BansChanged})
+
+	return nil
+}
+
+// RemoveBan removes the ban with the given rule.
+func (s *SQLite) RemoveBan(ctx context.Context, rule server.BanRule) error {
+	res, err := s.db.ExecContext(ctx, s.deleteBanSQL(), rule.Match, rule.Value)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return server.ErrNotFound
+	}
+
+	s.events.Publish(events.Event{Kind: events.BansChanged})
+
+	return nil
+}
+
+// RecordAudit appends entries to the audit trail.
+func (s *SQLite) RecordAudit(ctx context.Context, entries []server.AuditEntry) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, e := range entries {
+		_, err := tx.ExecContext(ctx, s.insertAuditSQL(), e.At.UnixNano(), e.Action, e.Actor, e.TeamID, e.Count, e.Detail, e.SourceIP, e.RequestID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetAudit returns the matching audit entries, newest first.
+func (s *SQLite) GetAudit(ctx context.Context, filter server.AuditFilter) ([]server.AuditEntry, error) {
+
+	entries := []server.AuditEntry{}
+
+	since := sql.NullInt64{Int64: filter.Since.UnixNano(), Valid: !filter.Since.IsZero()}
+	until := sql.NullInt64{Int64: filter.Until.UnixNano(), Valid: !filter.Until.IsZero()}
+	rows, err := s.db.QueryContext(ctx, s.selectAuditSQL(), filter.Action, filter.Actor, filter.TeamID, filter.SourceIP, since, until, filter.Limit)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e server.AuditEntry
+		var at int64
+		err := rows.Scan(&at, &e.Action, &e.Actor, &e.TeamID, &e.Count, &e.Detail, &e.SourceIP, &e.RequestID)
+		if err != nil {
+			return entries, err
+		}
+		e.At = time.Unix(0, at).UTC()
+		entries = append(entries, e)
+	}
+	err = rows.Err()
+	if err != nil {
+		return entries, err
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,911 @@
+// Copyright 2021 Fabian Bergström
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storetest checks that a server.Store behaves like all the others.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fabjan/mmocg/events"
+	"github.com/fabjan/mmocg/server"
+)
+
+// Factory creates an empty store publishing its events on the given bus.
+// It should clean up after itself with t.Cleanup, the store is closed by Run.
+type Factory func(t *testing.T, bus *events.Bus) server.Store
+
+// EventTimeout is how long to wait for events to be published.
+var EventTimeout = 2 * time.Second
+
+// Run runs the whole suite, with a new store for each test.
+func Run(t *testing.T, newStore Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s *subject)
+	}{
+		{"CreateTeam", testCreateTeam},
+		{"FindByID", testFindByID},
+		{"RecordClicks", testRecordClicks},
+		{"Leaderboard", testLeaderboard},
+		{"LeaderboardPage", testLeaderboardPage},
+		{"LeaderboardCursor", testLeaderboardCursor},
+		{"LeaderboardAround", testLeaderboardAround},
+		{"WindowLeaderboard", testWindowLeaderboard},
+		{"Standing", testStanding},
+		{"Seasons", testSeasons},
+		{"TeamEvents", testTeamEvents},
+		{"LeaderEvents", testLeaderEvents},
+		{"ConcurrentClicks", testConcurrentClicks},
+		{"ConcurrentLeadChange", testConcurrentLeadChange},
+		{"ConcurrentLeadFlips", testConcurrentLeadFlips},
+		{"DeleteTeam", testDeleteTeam},
+		{"RenameTeam", testRenameTeam},
+		{"ResetTeam", testResetTeam},
+		{"AdjustClicks", testAdjustClicks},
+		{"RecentTeams", testRecentTeams},
+		{"ModerationEvents", testModerationEvents},
+		{"Bans", testBans},
+		{"Audit", testAudit},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			bus := events.NewBus()
+			sub := bus.Subscribe(100000, events.DropNewest)
+			defer sub.Close()
+
+			st := newStore(t, bus)
+			defer st.Close()
+
+			tt.test(t, &subject{st, sub})
+		})
+	}
+}
+
+// subject is a store under test, and its events
+type subject struct {
+	server.Store
+	events *events.Subscription
+}
+
+func (s *subject) create(t *testing.T, teamIDs ...string) {
+	t.Helper()
+	for _, id := range teamIDs {
+		_, err := s.CreateTeam(context.Background(), id)
+		if err != nil {
+			t.Fatalf("CreateTeam(%q): %v", id, err)
+		}
+	}
+}
+
+func (s *subject) click(t *testing.T, teamID string, count int64) server.Team {
+	t.Helper()
+	team, err := s.RecordClicks(context.Background(), teamID, count)
+	if err != nil {
+		t.Fatalf("RecordClicks(%q, %d): %v", teamID, count, err)
+	}
+	return team
+}
+
+// collect returns the events of the given kind published so far
+func (s *subject) collect(kind events.Kind) []string {
+	return s.collectKinds(kind)[kind]
+}
+
+// collectKinds returns the events of each given kind published so far
+func (s *subject) collectKinds(kinds ...events.Kind) map[events.Kind][]string {
+	ids := make(map[events.Kind][]string)
+	quiet := time.NewTimer(EventTimeout)
+	defer quiet.Stop()
+	for {
+		select {
+		case e := <-s.events.C:
+			for _, kind := range kinds {
+				if e.Kind == kind {
+					ids[kind] = append(ids[kind], e.TeamID)
+				}
+			}
+			// wait a little for stragglers, they might come from another goroutine
+			quiet.Reset(EventTimeout / 10)
+		case <-quiet.C:
+			return ids
+		}
+	}
+}
+
+// expect fails unless the leaderboard is exactly the expected teams
+func expect(t *testing.T, what string, lb server.Leaderboard, err error, want ...server.Team) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+	if len(lb) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual([]server.Team(lb), want) {
+		t.Fatalf("%s:\ngot  %v\nwant %v", what, lb, want)
+	}
+}
+
+func team(id string, clicks int64) server.Team {
+	return server.Team{ID: id, Clicks: clicks}
+}
+
+func testCreateTeam(t *testing.T, s *subject) {
+	ctx := context.Background()
+
+	created, err := s.CreateTeam(ctx, "a")
+	if err != nil {
+		t.Fatalf("CreateTeam: %v", err)
+	}
+	if created != team("a", 0) {
+		t.Errorf("created %v, want a new team", created)
+	}
+
+	s.click(t, "a", 3)
+
+	existing, err := s.CreateTeam(ctx, "a")
+	if err == nil {
+		t.Fatalf("creating a team twice should fail")
+	}
+	if existing != team("a", 3) {
+		t.Errorf("conflict returned %v, want the existing team", existing)
+	}
+}
+
+func testFindByID(t *testing.T, s *subject) {
+	ctx := context.Background()
+	s.create(t, "a")
+	s.click(t, "a", 2)
+
+	found, err := s.FindByID(ctx, "a")
+	if err != nil {
+		t.Fatalf("FindByID: %v", err)
+	}
+	if found != team("a", 2) {
+		t.Errorf("found %v", found)
+	}
+
+	_, err = s.FindByID(ctx, "nope")
+	if !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("finding a missing team should fail: got %v, want ErrNotFound", err)
+	}
+}
+
+func testRecordClicks(t *testing.T, s *subject) {
+	ctx := context.Background()
+	s.create(t, "a")
+
+	for i := int64(1); i <= 10; i++ {
+		clicked := s.click(t, "a", i)
+		if want := team("a", i*(i+1)/2); clicked != want {
+			t.Fatalf("clicked %v, want %v", clicked, want)
+		}
+	}
+
+	found, err := s.FindByID(ctx, "a")
+	if err != nil || found != team("a", 55) {
+		t.Errorf("found %v (%v) after clicking", found, err)
+	}
+
+	_, err = s.RecordClicks(ctx, "nope", 1)
+	if !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("clicking a missing team should fail: got %v, want ErrNotFound", err)
+	}
+	_, err = s.FindByID(ctx, "nope")
+	if !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("clicking a missing team should not create it: got %v, want ErrNotFound", err)
+	}
+}
+
+func testLeaderboard(t *testing.T, s *subject) {
+	ctx := context.Background()
+
+	lb, err := s.GetLeaderboard(ctx)
+	expect(t, "empty leaderboard", lb, err)
+
+	s.create(t, "c", "b", "a", "idle")
+	s.click(t, "b", 5)
+	s.click(t, "c", 7)
+	s.click(t, "a", 5)
+
+	// ties are broken by ID, and teams without clicks are not listed
+	lb, err = s.GetLeaderboard(ctx)
+	expect(t, "leaderboard", lb, err, team("c", 7), team("a", 5), team("b", 5))
+}
+
+func testLeaderboardPage(t *testing.T, s *subject) {
+	ctx := context.Background()
+
+	var all []server.Team
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("t%d", i)
+		s.create(t, id)
+		s.click(t, id, int64(10-i))
+		all = append(all, team(id, int64(10-i)))
+	}
+	s.create(t, "idle")
+
+	lb, err := s.GetLeaderboardPage(ctx, nil, 0, 3)
+	expect(t, "first page", lb, err, all[:3]...)
+	lb, err = s.GetLeaderboardPage(ctx, nil, 3, 3)
+	expect(t, "second page", lb, err, all[3:6]...)
+	lb, err = s.GetLeaderboardPage(ctx, nil, 8, 3)
+	expect(t, "last page", lb, err, all[8:]...)
+	lb, err = s.GetLeaderboardPage(ctx, nil, 10, 3)
+	expect(t, "past the end", lb, err)
+}
+
+func testLeaderboardCursor(t *testing.T, s *subject) {
+	ctx := context.Background()
+
+	var all []server.Team
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("t%d", i)
+		s.create(t, id)
+		// pairs of teams tie
+		clicks := int64(10 - i/2)
+		s.click(t, id, clicks)
+		all = append(all, team(id, clicks))
+	}
+	s.create(t, "idle")
+
+	cursor := server.CursorAfter(all[:3])
+	lb, err := s.GetLeaderboardPage(ctx, &cursor, 0, 3)
+	expect(t, "after a tie", lb, err, all[3:6]...)
+	lb, err = s.GetLeaderboardPage(ctx, &cursor, 2, 3)
+	expect(t, "offset after the cursor", lb, err, all[5:8]...)
+
+	// teams above the cursor moving don't shift the next page
+	s.click(t, "t8", 100)
+	lb, err = s.GetLeaderboardPage(ctx, &cursor, 0, 3)
+	expect(t, "after teams moved", lb, err, all[3:6]...)
+
+	// the team at the cursor may be gone
+	gone := server.Cursor{Clicks: 8, TeamID: "t4a"}
+	lb, err = s.GetLeaderboardPage(ctx, &gone, 0, 2)
+	expect(t, "after a missing team", lb, err, all[5:7]...)
+
+	last := server.CursorAfter(all)
+	lb, err = s.GetLeaderboardPage(ctx, &last, 0, 3)
+	expect(t, "past the end", lb, err)
+}
+
+func testLeaderboardAround(t *testing.T, s *subject) {
+	ctx := context.Background()
+
+	var all []server.Team
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("t%d", i)
+		s.create(t, id)
+		// pairs of teams tie
+		clicks := int64(10 - i/2)
+		s.click(t, id, clicks)
+		all = append(all, team(id, clicks))
+	}
+	s.create(t, "idle")
+
+	lb, err := s.GetLeaderboardAround(ctx, "t5", 2)
+	expect(t, "around the middle", lb, err, all[3:8]...)
+	lb, err = s.GetLeaderboardAround(ctx, "t0", 2)
+	expect(t, "around the top", lb, err, all[:3]...)
+	lb, err = s.GetLeaderboardAround(ctx, "t9", 2)
+	expect(t, "around the bottom", lb, err, all[7:]...)
+	lb, err = s.GetLeaderboardAround(ctx, "idle", 2)
+	expect(t, "around a team without clicks", lb, err, all[8:]...)
+
+	_, err = s.GetLeaderboardAround(ctx, "nope", 2)
+	if !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("around a missing team should fail: got %v, want ErrNotFound", err)
+	}
+}
+
+func testWindowLeaderboard(t *testing.T, s *subject) {
+	ctx := context.Background()
+	s.create(t, "a", "b", "idle")
+	s.click(t, "a", 2)
+	s.click(t, "b", 3)
+	s.click(t, "a", 2)
+
+	for _, window := range []time.Duration{time.Hour, 24 * time.Hour, 7 * 24 * time.Hour} {
+		lb, err := s.GetWindowLeaderboard(ctx, window, 0, 10)
+		expect(t, "window "+window.String(), lb, err, team("a", 4), team("b", 3))
+	}
+
+	lb, err := s.GetWindowLeaderboard(ctx, time.Hour, 1, 10)
+	expect(t, "window page", lb, err, team("b", 3))
+}
+
+func testStanding(t *testing.T, s *subject) {
+	ctx := context.Background()
+	s.create(t, "a", "b", "c", "idle")
+	s.click(t, "a", 10)
+	s.click(t, "b", 4)
+	s.click(t, "c", 4)
+
+	tests := []struct {
+		teamID string
+		want   server.Standing
+	}{
+		{"a", server.Standing{Rank: 1}},
+		{"b", server.Standing{Rank: 2, ClicksToNextRank: 6}},
+		{"c", server.Standing{Rank: 2, ClicksToNextRank: 6}},
+		{"idle", server.Standing{Rank: 4, ClicksToNextRank: 4}},
+	}
+	for _, tt := range tests {
+		got, err := s.GetStanding(ctx, tt.teamID)
+		if err != nil {
+			t.Fatalf("GetStanding(%q): %v", tt.teamID, err)
+		}
+		if got != tt.want {
+			t.Errorf("GetStanding(%q) = %+v, want %+v", tt.teamID, got, tt.want)
+		}
+	}
+
+	_, err := s.GetStanding(ctx, "nope")
+	if !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("standing of a missing team should fail: got %v, want ErrNotFound", err)
+	}
+}
+
+func testSeasons(t *testing.T, s *subject) {
+	ctx := context.Background()
+
+	seasons, err := s.GetSeasons(ctx)
+	if err != nil || len(seasons) != 0 {
+		t.Fatalf("GetSeasons = %v, %v before any season ended", seasons, err)
+	}
+
+	s.create(t, "a", "b", "idle")
+	s.click(t, "a", 5)
+	s.click(t, "b", 7)
+
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	first := server.Season{ID: "s1", Start: start, End: start.AddDate(0, 1, 0)}
+	second := server.Season{ID: "s2", Start: first.End, End: first.End.AddDate(0, 1, 0)}
+
+	err = s.EndSeason(ctx, first)
+	if err != nil {
+		t.Fatalf("EndSeason: %v", err)
+	}
+	err = s.EndSeason(ctx, first)
+	if !errors.Is(err, server.ErrSeasonArchived) {
+		t.Fatalf("ending a season twice = %v, want ErrSeasonArchived", err)
+	}
+
+	lb, err := s.GetLeaderboard(ctx)
+	expect(t, "leaderboard after the season", lb, err)
+	found, err := s.FindByID(ctx, "a")
+	if err != nil || found != team("a", 0) {
+		t.Errorf("found %v (%v) after the season, want a reset team", found, err)
+	}
+
+	s.click(t, "a", 1)
+	err = s.EndSeason(ctx, second)
+	if err != nil {
+		t.Fatalf("EndSeason: %v", err)
+	}
+
+	seasons, err = s.GetSeasons(ctx)
+	if err != nil {
+		t.Fatalf("GetSeasons: %v", err)
+	}
+	if len(seasons) != 2 || seasons[0].ID != "s1" || seasons[1].ID != "s2" {
+		t.Fatalf("GetSeasons = %v", seasons)
+	}
+	if !seasons[0].Start.Equal(first.Start) || !seasons[0].End.Equal(first.End) {
+		t.Errorf("season %v has the wrong times", seasons[0])
+	}
+
+	lb, err = s.GetSeasonLeaderboard(ctx, "s1")
+	expect(t, "first season", lb, err, team("b", 7), team("a", 5))
+	lb, err = s.GetSeasonLeaderboard(ctx, "s2")
+	expect(t, "second season", lb, err, team("a", 1))
+
+	_, err = s.GetSeasonLeaderboard(ctx, "nope")
+	if !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("leaderboard of a missing season should fail: got %v, want ErrNotFound", err)
+	}
+}
+
+func testTeamEvents(t *testing.T, s *subject) {
+	s.create(t, "a", "b")
+	_, err := s.CreateTeam(context.Background(), "a")
+	if err == nil {
+		t.Fatalf("creating a team twice should fail")
+	}
+
+	got := s.collect(events.TeamCreated)
+	if want := []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("teams created %v, want %v", got, want)
+	}
+}
+
+func testLeaderEvents(t *testing.T, s *subject) {
+	s.create(t, "a", "b", "c")
+	s.click(t, "a", 1) // first to score
+	s.click(t, "a", 1) // already leading
+	s.click(t, "b", 2) // only a tie
+	s.click(t, "b", 1) // takes the lead
+	s.click(t, "c", 2) // not enough
+	s.click(t, "a", 2) // takes it back
+
+	got := s.collect(events.LeaderChanged)
+	if want := []string{"a", "b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("leaders %v, want %v", got, want)
+	}
+}
+
+func testConcurrentClicks(t *testing.T, s *subject) {
+	const teams, clickers, clicks = 3, 8, 50
+	for i := 0; i < teams; i++ {
+		s.create(t, fmt.Sprintf("t%d", i))
+	}
+
+	var wg sync.WaitGroup
+	for c := 0; c < clickers; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < clicks; i++ {
+				id := fmt.Sprintf("t%d", (c+i)%teams)
+				_, err := s.RecordClicks(context.Background(), id, 1)
+				if err != nil {
+					t.Errorf("RecordClicks(%q): %v", id, err)
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	total := int64(0)
+	for i := 0; i < teams; i++ {
+		found, err := s.FindByID(context.Background(), fmt.Sprintf("t%d", i))
+		if err != nil {
+			t.Fatalf("FindByID: %v", err)
+		}
+		total += found.Clicks
+	}
+	if total != clickers*clicks {
+		t.Errorf("%d clicks recorded, want %d", total, clickers*clicks)
+	}
+}
+
+func testConcurrentLeadChange(t *testing.T, s *subject) {
+	const lead, clickers, clicks = 100, 10, 20
+	s.create(t, "leader", "challenger")
+	s.click(t, "leader", lead)
+	s.collect(events.LeaderChanged)
+
+	// the challenger passes the leader exactly once, no matter who clicks
+	var wg sync.WaitGroup
+	for c := 0; c < clickers; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < clicks; i++ {
+				_, err := s.RecordClicks(context.Background(), "challenger", 1)
+				if err != nil {
+					t.Errorf("RecordClicks: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	got := s.collect(events.LeaderChanged)
+	if want := []string{"challenger"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("leaders %v, want %v", got, want)
+	}
+}
+
+func testConcurrentLeadFlips(t *testing.T, s *subject) {
+	const clickers, clicks = 10, 20
+	ctx := context.Background()
+	s.create(t, "a", "b")
+	s.click(t, "a", 1)
+	s.collect(events.LeaderChanged)
+
+	// the lead goes back and forth, every change must be seen exactly once
+	var wg sync.WaitGroup
+	for c := 0; c < 2*clickers; c++ {
+		teamID := []string{"a", "b"}[c%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < clicks; i++ {
+				_, err := s.RecordClicks(ctx, teamID, 1)
+				if err != nil {
+					t.Errorf("RecordClicks: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// events from different clicks can be published in any order, but
+	// counted they must alternate: b took the lead first, then a, then b...
+	taken := map[string]int{}
+	for _, teamID := range s.collect(events.LeaderChanged) {
+		taken[teamID]++
+	}
+	if d := taken["b"] - taken["a"]; d < 0 || 1 < d {
+		t.Fatalf("lead taken by b %d times and by a %d times, they must alternate", taken["b"], taken["a"])
+	}
+
+	a, err := s.FindByID(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.FindByID(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader, other := a, b
+	if taken["b"] > taken["a"] {
+		leader, other = b, a
+	}
+	if leader.Clicks < other.Clicks {
+		t.Errorf("%s has the lead according to the events, but %v has more clicks than %v", leader.ID, other, leader)
+	}
+}
+
+func testDeleteTeam(t *testing.T, s *subject) {
+	ctx := context.Background()
+	s.create(t, "a", "b")
+	s.click(t, "a", 5)
+	s.click(t, "b", 3)
+
+	err := s.DeleteTeam(ctx, "a")
+	if err != nil {
+		t.Fatalf("DeleteTeam: %v", err)
+	}
+
+	_, err = s.FindByID(ctx, "a")
+	if !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("a deleted team should not be found: got %v, want ErrNotFound", err)
+	}
+	lb, err := s.GetLeaderboard(ctx)
+	expect(t, "leaderboard", lb, err, team("b", 3))
+	lb, err = s.GetWindowLeaderboard(ctx, time.Hour, 0, 10)
+	expect(t, "window", lb, err, team("b", 3))
+
+	err = s.DeleteTeam(ctx, "a")
+	if !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("deleting a missing team should fail: got %v, want ErrNotFound", err)
+	}
+
+	// the ID can be used again
+	s.create(t, "a")
+}
+
+func testRenameTeam(t *testing.T, s *subject) {
+	ctx := context.Background()
+	s.create(t, "a", "b")
+	s.click(t, "a", 5)
+	s.click(t, "b", 3)
+
+	renamed, err := s.RenameTeam(ctx, "a", "c")
+	if err != nil {
+		t.Fatalf("RenameTeam: %v", err)
+	}
+	if renamed != team("c", 5) {
+		t.Errorf("renamed %v, want c with a's clicks", renamed)
+	}
+	_, err = s.FindByID(ctx, "a")
+	if !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("the old ID should not be found: got %v, want ErrNotFound", err)
+	}
+
+	merged, err := s.RenameTeam(ctx, "c", "b")
+	if err != nil {
+		t.Fatalf("RenameTeam: %v", err)
+	}
+	if merged != team("b", 8) {
+		t.Errorf("merged %v, want b with both teams' clicks", merged)
+	}
+
+	lb, err := s.GetLeaderboard(ctx)
+	expect(t, "leaderboard", lb, err, team("b", 8))
+	lb, err = s.GetWindowLeaderboard(ctx, time.Hour, 0, 10)
+	expect(t, "window", lb, err, team("b", 8))
+
+	_, err = s.RenameTeam(ctx, "a", "d")
+	if !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("renaming a missing team should fail: got %v, want ErrNotFound", err)
+	}
+}
+
+func testResetTeam(t *testing.T, s *subject) {
+	ctx := context.Background()
+	s.create(t, "a", "b")
+	s.click(t, "a", 5)
+	s.click(t, "b", 3)
+
+	reset, err := s.ResetTeam(ctx, "a")
+	if err != nil {
+		t.Fatalf("ResetTeam: %v", err)
+	}
+	if reset != team("a", 0) {
+		t.Errorf("reset %v, want a without clicks", reset)
+	}
+
+	lb, err := s.GetLeaderboard(ctx)
+	expect(t, "leaderboard", lb, err, team("b", 3))
+	lb, err = s.GetWindowLeaderboard(ctx, time.Hour, 0, 10)
+	expect(t, "window", lb, err, team("b", 3))
+
+	_, err = s.ResetTeam(ctx, "c")
+	if !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("resetting a missing team should fail: got %v, want ErrNotFound", err)
+	}
+}
+
+func testAdjustClicks(t *testing.T, s *subject) {
+	ctx := context.Background()
+	s.create(t, "a", "b")
+	s.click(t, "a", 5)
+	s.click(t, "b", 3)
+
+	adjusted, err := s.AdjustClicks(ctx, "b", 4)
+	if err != nil {
+		t.Fatalf("AdjustClicks: %v", err)
+	}
+	if adjusted != team("b", 7) {
+		t.Errorf("adjusted %v, want b with 7 clicks", adjusted)
+	}
+
+	adjusted, err = s.AdjustClicks(ctx, "a", -20)
+	if err != nil {
+		t.Fatalf("AdjustClicks: %v", err)
+	}
+	if adjusted != team("a", 0) {
+		t.Errorf("adjusted %v, want a without clicks", adjusted)
+	}
+
+	lb, err := s.GetLeaderboard(ctx)
+	expect(t, "leaderboard", lb, err, team("b", 7))
+
+	// adjustments are not played, so they don't count in windows
+	lb, err = s.GetWindowLeaderboard(ctx, time.Hour, 0, 10)
+	expect(t, "window", lb, err, team("a", 5), team("b", 3))
+
+	_, err = s.AdjustClicks(ctx, "c", 1)
+	if !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("adjusting a missing team should fail: got %v, want ErrNotFound", err)
+	}
+}
+
+func testRecentTeams(t *testing.T, s *subject) {
+	ctx := context.Background()
+	s.create(t, "old")
+	// some stores only keep whole seconds
+	time.Sleep(1100 * time.Millisecond)
+	s.create(t, "new1", "new2")
+	s.click(t, "new1", 2)
+
+	recent, err := s.GetRecentTeams(ctx, 2)
+	if err != nil {
+		t.Fatalf("GetRecentTeams: %v", err)
+	}
+	got := map[server.Team]bool{}
+	for _, created := range recent {
+		got[created.Team] = true
+		if time.Since(created.CreatedAt) > time.Minute {
+			t.Errorf("%s was created at %v, want just now", created.ID, created.CreatedAt)
+		}
+	}
+	want := map[server.Team]bool{team("new1", 2): true, team("new2", 0): true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("recent teams %v, want new1 and new2", recent)
+	}
+
+	recent, err = s.GetRecentTeams(ctx, 10)
+	if err != nil {
+		t.Fatalf("GetRecentTeams: %v", err)
+	}
+	if len(recent) != 3 || recent[2].ID != "old" {
+		t.Errorf("all recent teams %v, want the old one last", recent)
+	}
+}
+
+func testModerationEvents(t *testing.T, s *subject) {
+	ctx := context.Background()
+	s.create(t, "a", "b", "c")
+	s.click(t, "a", 5)
+	s.click(t, "b", 3)
+	s.click(t, "c", 4)
+
+	steps := []struct {
+		what   string
+		change func() error
+	}{
+		{"delete the leader", func() error {
+			return s.DeleteTeam(ctx, "a")
+		}},
+		{"reset the leader", func() error {
+			_, err := s.ResetTeam(ctx, "c")
+			return err
+		}},
+		{"rename the leader", func() error {
+			_, err := s.RenameTeam(ctx, "b", "d")
+			return err
+		}},
+		{"take the leader's clicks", func() error {
+			_, err := s.AdjustClicks(ctx, "d", -10)
+			return err
+		}},
+	}
+	for _, step := range steps {
+		err := step.change()
+		if err != nil {
+			t.Fatalf("%s: %v", step.what, err)
+		}
+	}
+
+	got := s.collectKinds(events.LeaderChanged, events.TeamChanged)
+	leaders, changed := got[events.LeaderChanged], got[events.TeamChanged]
+
+	if want := []string{"a", "c", "b"}; !reflect.DeepEqual(leaders, want) {
+		t.Errorf("leaders %v, want %v", leaders, want)
+	}
+	if want := []string{"a", "c", "b", "d", "d"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed teams %v, want %v", changed, want)
+	}
+}
+
+func testBans(t *testing.T, s *subject) {
+	ctx := context.Background()
+
+	bans, err := s.GetBans(ctx)
+	if err != nil || len(bans) != 0 {
+		t.Fatalf("GetBans = %v, %v, want none", bans, err)
+	}
+
+	// some stores only keep whole seconds
+	start := time.Now().UTC().Truncate(time.Second)
+	ban := func(match server.BanMatch, value, reason string, age int) server.Ban {
+		return server.Ban{
+			BanRule:   server.BanRule{Match: match, Value: value},
+			Reason:    reason,
+			CreatedAt: start.Add(time.Duration(age) * time.Second),
+		}
+	}
+	added := []server.Ban{
+		ban(server.BanExact, "🐱", "rude", 0),
+		ban(server.BanCategory, "flag", "", 1),
+		ban(server.BanContains, "🖕", "rude", 2),
+		// replaces the first one
+		ban(server.BanExact, "🐱", "reserved", 3),
+	}
+	for _, b := range added {
+		err := s.AddBan(ctx, b)
+		if err != nil {
+			t.Fatalf("AddBan(%v): %v", b, err)
+		}
+	}
+
+	err = s.RemoveBan(ctx, added[1].BanRule)
+	if err != nil {
+		t.Fatalf("RemoveBan: %v", err)
+	}
+	err = s.RemoveBan(ctx, added[1].BanRule)
+	if !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("removing a ban twice succeeded: got %v, want ErrNotFound", err)
+	}
+
+	bans, err = s.GetBans(ctx)
+	if err != nil {
+		t.Fatalf("GetBans: %v", err)
+	}
+	want := []server.Ban{added[2], added[3]}
+	if len(bans) != len(want) {
+		t.Fatalf("bans %v, want %v", bans, want)
+	}
+	for i := range want {
+		if bans[i].BanRule != want[i].BanRule || bans[i].Reason != want[i].Reason || !bans[i].CreatedAt.Equal(want[i].CreatedAt) {
+			t.Errorf("ban %d is %v, want %v", i, bans[i], want[i])
+		}
+	}
+
+	if changes := s.collect(events.BansChanged); len(changes) != 5 {
+		t.Errorf("%d ban changes published, want 5", len(changes))
+	}
+}
+
+func testAudit(t *testing.T, s *subject) {
+	ctx := context.Background()
+
+	// some stores don't keep nanoseconds
+	start := time.Now().UTC().Truncate(time.Second)
+	entry := func(age int, action server.AuditAction, teamID, ip string) server.AuditEntry {
+		return server.AuditEntry{
+			At:        start.Add(time.Duration(age) * time.Second),
+			Action:    action,
+			Actor:     server.ActorPlayer,
+			TeamID:    teamID,
+			SourceIP:  ip,
+			RequestID: fmt.Sprintf("req-%d", age),
+		}
+	}
+	err := s.RecordAudit(ctx, []server.AuditEntry{
+		entry(0, server.AuditCreateTeam, "a", "10.0.0.1"),
+		entry(1, server.AuditCreateTeam, "b", "10.0.0.2"),
+	})
+	if err != nil {
+		t.Fatalf("RecordAudit: %v", err)
+	}
+	clicks := entry(2, server.AuditClicks, "a", "10.0.0.2")
+	clicks.Count = 42
+	clicks.Detail = "7 requests"
+	err = s.RecordAudit(ctx, []server.AuditEntry{clicks})
+	if err != nil {
+		t.Fatalf("RecordAudit: %v", err)
+	}
+
+	tests := []struct {
+		what   string
+		filter server.AuditFilter
+		want   []string
+	}{
+		{"all", server.AuditFilter{}, []string{"req-2", "req-1", "req-0"}},
+		{"limited", server.AuditFilter{Limit: 2}, []string{"req-2", "req-1"}},
+		{"by action", server.AuditFilter{Action: server.AuditCreateTeam}, []string{"req-1", "req-0"}},
+		{"by team", server.AuditFilter{TeamID: "a"}, []string{"req-2", "req-0"}},
+		{"by source", server.AuditFilter{SourceIP: "10.0.0.2"}, []string{"req-2", "req-1"}},
+		{"by actor", server.AuditFilter{Actor: server.ActorAdmin}, []string{}},
+		{"since", server.AuditFilter{Since: start.Add(time.Second)}, []string{"req-2", "req-1"}},
+		{"until", server.AuditFilter{Until: start.Add(time.Second)}, []string{"req-0"}},
+	}
+	for _, tt := range tests {
+		if tt.filter.Limit == 0 {
+			tt.filter.Limit = 10
+		}
+		entries, err := s.GetAudit(ctx, tt.filter)
+		if err != nil {
+			t.Fatalf("GetAudit %s: %v", tt.what, err)
+		}
+		got := []string{}
+		for _, e := range entries {
+			got = append(got, e.RequestID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("audit entries %s: %v, want %v", tt.what, got, tt.want)
+		}
+	}
+
+	entries, err := s.GetAudit(ctx, server.AuditFilter{Action: server.AuditClicks, Limit: 1})
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("GetAudit clicks = %v, %v", entries, err)
+	}
+	got := entries[0]
+	if !got.At.Equal(clicks.At) {
+		t.Errorf("clicks entry made at %v, want %v", got.At, clicks.At)
+	}
+	got.At = clicks.At
+	if got != clicks {
+		t.Errorf("clicks entry %+v, want %+v", got, clicks)
+	}
+}